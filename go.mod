@@ -6,6 +6,7 @@ require (
 	github.com/docker/machine v0.16.2
 	github.com/stretchr/testify v1.7.0
 	github.com/vmware/go-vcloud-director/v2 v2.14.0
+	golang.org/x/sys v0.0.0-20210616094352-59db8d763f22
 )
 
 require (
@@ -20,7 +21,6 @@ require (
 	github.com/peterhellberg/link v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/crypto v0.0.0-20220214200702-86341886e292 // indirect
-	golang.org/x/sys v0.0.0-20210616094352-59db8d763f22 // indirect
 	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1 // indirect
 	gopkg.in/yaml.v2 v2.4.0
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
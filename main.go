@@ -18,10 +18,26 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/docker/machine/libmachine/drivers/plugin"
 	"github.com/negashev/docker-machine-driver-vcd/vmwarevcloud"
 )
 
+// subcommands run standalone instead of serving the driver plugin.
+var subcommands = map[string]func(args []string) error{}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	plugin.RegisterDriver(vmwarevcloud.NewDriver("", ""))
 }
@@ -0,0 +1,99 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/negashev/docker-machine-driver-vcd/vmwarevcloud"
+)
+
+const snapshotUsage = `Usage: docker-machine-driver-vcd snapshot [options] create|revert|remove MACHINE
+
+Manages the snapshot of a docker-machine vcd machine. vCloud Director keeps
+one snapshot per machine, create replaces it.
+
+Options:
+`
+
+// snapshotCommand is a parsed "snapshot" subcommand line.
+type snapshotCommand struct {
+	storePath string
+	action    string
+	machine   string
+	name      string
+	memory    bool
+	quiesce   bool
+}
+
+// parseSnapshotArgs parses the arguments of the "snapshot" subcommand.
+func parseSnapshotArgs(args []string) (*snapshotCommand, error) {
+	cmd := &snapshotCommand{}
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	fs.StringVar(&cmd.storePath, "storage-path", vmwarevcloud.DefaultStorePath(), "docker-machine storage path")
+	fs.StringVar(&cmd.name, "name", "docker-machine", "snapshot name (create)")
+	fs.BoolVar(&cmd.memory, "memory", false, "include the memory state (create)")
+	fs.BoolVar(&cmd.quiesce, "quiesce", false, "quiesce the guest file systems (create)")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), snapshotUsage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return nil, fmt.Errorf("expected an action and a machine name")
+	}
+
+	cmd.action, cmd.machine = fs.Arg(0), fs.Arg(1)
+	switch cmd.action {
+	case "create", "revert", "remove":
+		return cmd, nil
+	}
+
+	fs.Usage()
+	return nil, fmt.Errorf("unknown snapshot action %q", cmd.action)
+}
+
+// runSnapshot implements the "snapshot" subcommand.
+func runSnapshot(args []string) error {
+	cmd, err := parseSnapshotArgs(args)
+	if err != nil {
+		return err
+	}
+
+	d, err := vmwarevcloud.LoadDriver(cmd.storePath, cmd.machine)
+	if err != nil {
+		return err
+	}
+
+	switch cmd.action {
+	case "create":
+		return d.CreateSnapshot(cmd.name, cmd.memory, cmd.quiesce)
+	case "revert":
+		return d.RevertSnapshot()
+	}
+	return d.RemoveSnapshot()
+}
+
+func init() {
+	subcommands["snapshot"] = runSnapshot
+}
@@ -0,0 +1,51 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSnapshotArgs(t *testing.T) {
+	cmd, err := parseSnapshotArgs([]string{"-storage-path", "/tmp/machine", "-name", "pre-upgrade", "-memory", "create", "default"})
+	assert.NoError(t, err)
+	assert.Equal(t, &snapshotCommand{
+		storePath: "/tmp/machine",
+		action:    "create",
+		machine:   "default",
+		name:      "pre-upgrade",
+		memory:    true,
+	}, cmd)
+
+	cmd, err = parseSnapshotArgs([]string{"revert", "default"})
+	assert.NoError(t, err)
+	assert.Equal(t, "revert", cmd.action)
+	assert.Equal(t, "docker-machine", cmd.name)
+
+	_, err = parseSnapshotArgs([]string{"create"})
+	assert.Error(t, err)
+
+	_, err = parseSnapshotArgs([]string{"list", "default"})
+	assert.Error(t, err)
+
+	_, err = parseSnapshotArgs([]string{"-unknown", "create", "default"})
+	assert.Error(t, err)
+}
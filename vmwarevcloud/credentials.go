@@ -0,0 +1,361 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Kinds of secret source, used for the password and the tokens. A source
+// is stored in the machine config as "<kind>:<value>", e.g.
+// "env:VCD_PASSWORD" or "file:/run/secrets/vcd".
+const (
+	secretSourceEnv    = "env"
+	secretSourceFile   = "file"
+	secretSourceHelper = "helper"
+)
+
+// credentialHelperPrefix is prepended to helper names, as docker does for
+// its credsStore setting.
+const credentialHelperPrefix = "docker-credential-"
+
+// credentialHelperReply is the answer of a docker credential helper "get".
+type credentialHelperReply struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// serviceAccountToken is the token file format used by vCloud Director
+// service accounts, as written by the VCD UI and CLI.
+type serviceAccountToken struct {
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	UpdatedBy    string `json:"updated_by"`
+	UpdatedOn    string `json:"updated_on"`
+}
+
+// oauthTokenResponse is the reply of the VCD OAuth token endpoint.
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// credentialSets returns how many complete credential sets are configured.
+// Only credential helpers supply the username along with the password.
+func (d *Driver) credentialSets() int {
+	n := 0
+	if (d.UserName != "" && (d.UserPassword != "" || d.PasswordSource != "")) || strings.HasPrefix(d.PasswordSource, secretSourceHelper+":") {
+		n++
+	}
+	if d.APIToken != "" || d.APITokenSource != "" {
+		n++
+	}
+	if d.Token != "" || d.TokenSource != "" {
+		n++
+	}
+	if d.ServiceAccountTokenFile != "" {
+		n++
+	}
+	return n
+}
+
+// credentialID names the identity used to log in, so cached sessions of
+// different identities never mix.
+func (d *Driver) credentialID() string {
+	switch {
+	case d.ServiceAccountTokenFile != "":
+		return "service-account:" + d.ServiceAccountTokenFile
+	case d.APIToken != "":
+		return "api-token:" + d.APIToken
+	case d.APITokenSource != "":
+		return "api-token-source:" + d.APITokenSource
+	case d.Token != "":
+		return "token:" + d.Token
+	case d.TokenSource != "":
+		return "token-source:" + d.TokenSource
+	}
+	if d.UserName == "" {
+		return "source:" + d.PasswordSource
+	}
+	return "user:" + d.UserName
+}
+
+// authenticate logs p in with whichever credential set the machine was
+// configured with.
+func (d *Driver) authenticate(p *govcd.VCDClient) error {
+	switch {
+	case d.ServiceAccountTokenFile != "":
+		return d.authenticateServiceAccount(p)
+	case d.APIToken != "" || d.APITokenSource != "":
+		apiToken, err := d.secret(d.APIToken, d.APITokenSource, "API token")
+		if err != nil {
+			return err
+		}
+		return p.SetToken(d.Org, govcd.ApiTokenHeader, apiToken)
+	case d.Token != "" || d.TokenSource != "":
+		token, err := d.secret(d.Token, d.TokenSource, "token")
+		if err != nil {
+			return err
+		}
+		// Legacy x-vcloud-authorization tokens are 32 characters long,
+		// anything longer is a bearer token.
+		authHeader := govcd.AuthorizationHeader
+		if len(token) > 32 {
+			authHeader = govcd.BearerTokenHeader
+		}
+		return p.SetToken(d.Org, authHeader, token)
+	}
+
+	username, password, err := d.credentials()
+	if err != nil {
+		return err
+	}
+	return p.Authenticate(username, password, d.Org)
+}
+
+// credentials returns the username and password, resolving the password
+// source at call time so that only its reference is kept in the machine
+// config.
+func (d *Driver) credentials() (string, string, error) {
+	if d.PasswordSource == "" {
+		return d.UserName, d.UserPassword, nil
+	}
+
+	username, password, err := d.resolveSecret(d.PasswordSource, "password")
+	if err != nil {
+		return "", "", err
+	}
+	if d.UserName != "" {
+		username = d.UserName
+	}
+	return username, password, nil
+}
+
+// secret returns value, or the secret its source points at when the value
+// is not stored in the machine config.
+func (d *Driver) secret(value, source, what string) (string, error) {
+	if source == "" {
+		return value, nil
+	}
+	_, secret, err := d.resolveSecret(source, what)
+	return secret, err
+}
+
+// resolveSecret reads the secret a source points at. Credential helpers
+// also return the username stored with the secret.
+func (d *Driver) resolveSecret(source, what string) (string, string, error) {
+	kind, value, err := parseSecretSource(source)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch kind {
+	case secretSourceEnv:
+		secret, ok := os.LookupEnv(value)
+		if !ok {
+			return "", "", fmt.Errorf("Environment variable %s holding the vCloud Director %s is not set", value, what)
+		}
+		return "", secret, nil
+	case secretSourceFile:
+		data, err := ioutil.ReadFile(value)
+		if err != nil {
+			return "", "", fmt.Errorf("Unable to read vCloud Director %s file: %s", what, err)
+		}
+		return "", strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	reply, err := runCredentialHelper(value, d.Href)
+	if err != nil {
+		return "", "", err
+	}
+	return reply.Username, reply.Secret, nil
+}
+
+// migratePassword drops the plaintext password of machines created before
+// password sources existed, once VCD_PASSWORD_SOURCE points at a source
+// holding the same password. docker-machine saves the config without the
+// password after the next start, stop, restart or kill.
+func (d *Driver) migratePassword() {
+	source := os.Getenv("VCD_PASSWORD_SOURCE")
+	if source == "" || d.PasswordSource != "" || d.UserPassword == "" {
+		return
+	}
+
+	legacy := d.UserPassword
+	d.PasswordSource, d.UserPassword = source, ""
+
+	_, password, err := d.credentials()
+	if err != nil || password != legacy {
+		log.Warnf("Not migrating %s to password source %s: the source does not hold the stored password", d.MachineName, source)
+		d.PasswordSource, d.UserPassword = "", legacy
+		return
+	}
+
+	log.Infof("Migrated %s to password source %s, the plaintext password will no longer be stored", d.MachineName, source)
+}
+
+// parseSecretSource splits a "<kind>:<value>" secret source reference.
+func parseSecretSource(source string) (string, string, error) {
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid secret source %q, expected env:<name>, file:<path> or helper:<name>", source)
+	}
+
+	switch parts[0] {
+	case secretSourceEnv, secretSourceFile, secretSourceHelper:
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("Invalid secret source %q, expected env:<name>, file:<path> or helper:<name>", source)
+}
+
+// runCredentialHelper asks a docker credential helper for the credentials
+// stored for serverURL.
+func runCredentialHelper(helper, serverURL string) (*credentialHelperReply, error) {
+	if !strings.HasPrefix(helper, credentialHelperPrefix) {
+		helper = credentialHelperPrefix + helper
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		return nil, fmt.Errorf("Credential helper %s failed: %s: %s", helper, err, msg)
+	}
+
+	reply := &credentialHelperReply{}
+	if err := json.Unmarshal(stdout.Bytes(), reply); err != nil {
+		return nil, fmt.Errorf("Unable to parse credential helper %s reply: %s", helper, err)
+	}
+	if reply.Secret == "" {
+		return nil, fmt.Errorf("Credential helper %s returned no secret for %s", helper, serverURL)
+	}
+
+	return reply, nil
+}
+
+// authenticateServiceAccount exchanges the refresh token of a service
+// account for an access token. Service account refresh tokens are single
+// use, so the new refresh token is written back to the token file.
+func (d *Driver) authenticateServiceAccount(p *govcd.VCDClient) error {
+	data, err := ioutil.ReadFile(d.ServiceAccountTokenFile)
+	if err != nil {
+		return fmt.Errorf("Unable to read service account token file: %s", err)
+	}
+
+	saToken := &serviceAccountToken{}
+	if err = json.Unmarshal(data, saToken); err != nil {
+		return fmt.Errorf("Unable to parse service account token file: %s", err)
+	}
+	if saToken.RefreshToken == "" {
+		return fmt.Errorf("Service account token file %s has no refresh_token", d.ServiceAccountTokenFile)
+	}
+
+	resp, err := d.refreshAccessToken(saToken.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	if resp.RefreshToken != "" {
+		saToken.RefreshToken = resp.RefreshToken
+		saToken.UpdatedBy = "docker-machine-driver-vcd"
+		saToken.UpdatedOn = time.Now().Format(time.RFC3339)
+		data, err = json.MarshalIndent(saToken, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(d.ServiceAccountTokenFile, data, 0600); err != nil {
+			return fmt.Errorf("Unable to save rotated service account token: %s", err)
+		}
+	}
+
+	return p.SetToken(d.Org, govcd.BearerTokenHeader, resp.AccessToken)
+}
+
+// refreshAccessToken runs the OAuth refresh-token grant against the tenant
+// (or provider, for the System org) token endpoint.
+func (d *Driver) refreshAccessToken(refreshToken string) (*oauthTokenResponse, error) {
+	endpoint := url.URL{Scheme: d.Url.Scheme, Host: d.Url.Host, Path: "/oauth/tenant/" + d.Org + "/token"}
+	if strings.EqualFold(d.Org, "system") {
+		endpoint.Path = "/oauth/provider/token"
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+
+	req, err := http.NewRequest(http.MethodPost, endpoint.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+		Transport: d.retryTransport(&http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: d.Insecure},
+		}),
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to refresh access token: %s", err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unable to refresh access token: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	token := &oauthTokenResponse{}
+	if err = json.Unmarshal(body, token); err != nil {
+		return nil, fmt.Errorf("Unable to parse access token response: %s", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("Access token response has no access_token")
+	}
+
+	return token, nil
+}
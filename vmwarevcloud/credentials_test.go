@@ -0,0 +1,105 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordSource(t *testing.T) {
+	driver := NewDriver("default", "path").(*Driver)
+	driver.UserName = "root"
+
+	os.Setenv("VCD_TEST_PASSWORD", "from-env")
+	defer os.Unsetenv("VCD_TEST_PASSWORD")
+
+	driver.PasswordSource = "env:VCD_TEST_PASSWORD"
+	_, password, err := driver.credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env", password)
+
+	f, err := ioutil.TempFile("", "vcd-password")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("from-file\n")
+	f.Close()
+
+	driver.PasswordSource = "file:" + f.Name()
+	_, password, err = driver.credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", password)
+
+	_, _, err = parseSecretSource("vault:secret")
+	assert.Error(t, err)
+
+	// Only credential helpers supply the username.
+	driver.UserName = ""
+	assert.Equal(t, 0, driver.credentialSets())
+	driver.PasswordSource = "helper:pass"
+	assert.Equal(t, 1, driver.credentialSets())
+}
+
+func TestTokenSource(t *testing.T) {
+	driver := NewDriver("default", "path").(*Driver)
+	driver.APITokenSource = "env:VCD_TEST_API_TOKEN"
+	assert.Equal(t, 1, driver.credentialSets())
+
+	_, err := driver.secret(driver.APIToken, driver.APITokenSource, "API token")
+	assert.Error(t, err)
+
+	os.Setenv("VCD_TEST_API_TOKEN", "from-env")
+	defer os.Unsetenv("VCD_TEST_API_TOKEN")
+
+	token, err := driver.secret(driver.APIToken, driver.APITokenSource, "API token")
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env", token)
+
+	data, err := json.Marshal(driver)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), `"APIToken"`)
+	assert.NotContains(t, string(data), `"Token"`)
+}
+
+func TestPasswordNotPersisted(t *testing.T) {
+	driver := NewDriver("default", "path").(*Driver)
+	driver.PasswordSource = "env:VCD_PASSWORD"
+
+	data, err := json.Marshal(driver)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "UserPassword")
+}
+
+func TestMigratePassword(t *testing.T) {
+	driver := NewDriver("default", "path").(*Driver)
+	driver.UserPassword = "legacy"
+
+	os.Setenv("VCD_TEST_PASSWORD", "legacy")
+	os.Setenv("VCD_PASSWORD_SOURCE", "env:VCD_TEST_PASSWORD")
+	defer os.Unsetenv("VCD_TEST_PASSWORD")
+	defer os.Unsetenv("VCD_PASSWORD_SOURCE")
+
+	driver.migratePassword()
+	assert.Equal(t, "", driver.UserPassword)
+	assert.Equal(t, "env:VCD_TEST_PASSWORD", driver.PasswordSource)
+}
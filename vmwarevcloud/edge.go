@@ -0,0 +1,344 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"fmt"
+	"strings"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Edge gateway types of -vcd-edge-type.
+const (
+	edgeTypeAuto = "auto"
+	edgeTypeNsxt = "nsxt"
+	edgeTypeNsxv = "nsxv"
+)
+
+// edgeTypeFromBacking returns the edge gateway type matching the backing
+// type of an Org VDC network, or "" when it tells neither.
+func edgeTypeFromBacking(backingType string) string {
+	switch {
+	case strings.HasPrefix(backingType, "NSXT"):
+		return edgeTypeNsxt
+	case backingType == "VIRTUAL_WIRE":
+		return edgeTypeNsxv
+	}
+	return ""
+}
+
+// isNsxv reports whether the edge gateway is NSX-V backed. Machines
+// created before the type was detected used NSX-V when -vcd-vdcedgegateway
+// was given.
+func (d *Driver) isNsxv() bool {
+	switch d.EdgeType {
+	case edgeTypeNsxv:
+		return true
+	case edgeTypeNsxt:
+		return false
+	}
+	return d.VdcEdgeGateway != ""
+}
+
+// resolveEdgeGateway finds the edge gateway the network of the primary NIC
+// is routed through when -vcd-edgegateway is not given, and detects its
+// type when -vcd-edge-type is auto, from the network backing or else from
+// the VDC holding the edge gateway.
+func (d *Driver) resolveEdgeGateway(c *vcdConnection, network string) error {
+	var backingType string
+	if d.EdgeGateway == "" || d.EdgeType == edgeTypeAuto {
+		orgNet, err := c.vdc.GetOpenApiOrgVdcNetworkByName(network)
+		if err != nil {
+			return fmt.Errorf("Unable to read Org VDC network %s: %s", network, err)
+		}
+		backingType = orgNet.OpenApiOrgVdcNetwork.BackingNetworkType
+
+		if d.EdgeGateway == "" {
+			connection := orgNet.OpenApiOrgVdcNetwork.Connection
+			if connection == nil || connection.RouterRef.Name == "" {
+				return fmt.Errorf("Org VDC network %s is not routed through an edge gateway, please specify -vcd-edgegateway", network)
+			}
+			d.EdgeGateway = connection.RouterRef.Name
+			log.Infof("Using edge gateway %s of Org VDC network %s", d.EdgeGateway, network)
+		}
+	}
+
+	if d.EdgeType != edgeTypeAuto {
+		return nil
+	}
+
+	d.EdgeType = edgeTypeFromBacking(backingType)
+	if d.EdgeType == "" {
+		vdc := c.vdc
+		if d.VdcEdgeGateway != "" {
+			var err error
+			if vdc, err = c.org.GetVDCByName(d.VdcEdgeGateway, true); err != nil {
+				return err
+			}
+		}
+		switch {
+		case vdc.IsNsxt():
+			d.EdgeType = edgeTypeNsxt
+		case vdc.IsNsxv():
+			d.EdgeType = edgeTypeNsxv
+		default:
+			d.EdgeType = edgeTypeAuto
+			return fmt.Errorf("Unable to detect the type of edge gateway %s, please specify -vcd-edge-type", d.EdgeGateway)
+		}
+	}
+
+	log.Debugf("Edge gateway %s is %s backed", d.EdgeGateway, d.EdgeType)
+	return nil
+}
+
+// nsxvEdge returns the NSX-V edge gateway, looked up in the
+// -vcd-vdcedgegateway VDC or else in the VDC of the machine.
+func (d *Driver) nsxvEdge(c *vcdConnection) (*govcd.EdgeGateway, error) {
+	vdc := c.vdc
+	if d.VdcEdgeGateway != "" {
+		var err error
+		if vdc, err = c.org.GetVDCByName(d.VdcEdgeGateway, true); err != nil {
+			return nil, err
+		}
+	}
+	return vdc.GetEdgeGatewayByName(d.EdgeGateway, true)
+}
+
+// nsxtEdge returns the NSX-T edge gateway.
+func (d *Driver) nsxtEdge(c *vcdConnection) (*govcd.NsxtEdgeGateway, error) {
+	adminOrg, err := c.client.GetAdminOrgByName(d.Org)
+	if err != nil {
+		return nil, err
+	}
+	return adminOrg.GetNsxtEdgeGatewayByName(d.EdgeGateway)
+}
+
+// publish creates the NAT and firewall rules making the machine reachable
+// on d.PublicIP, reserving the address first when it is auto. network is
+// the Org VDC network of the primary NIC. The rules are rolled back under
+// the edge gateway lock as well.
+func (d *Driver) publish(c *vcdConnection, network *types.OrgVDCNetwork, rb *rollback) error {
+	edgeRb := &rollback{}
+	rb.add("rules on edge gateway "+d.EdgeGateway, func() error {
+		unlock, err := d.lockEdgeGateway(c)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if !edgeRb.run() {
+			return fmt.Errorf("Some rules on edge gateway %s were not removed", d.EdgeGateway)
+		}
+		return nil
+	})
+
+	unlock, err := d.lockEdgeGateway(c)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return d.publishLocked(c, network, edgeRb)
+}
+
+// publishLocked is publish with the edge gateway lock held.
+func (d *Driver) publishLocked(c *vcdConnection, network *types.OrgVDCNetwork, rb *rollback) error {
+
+	if d.PublicIP == publicIPAuto {
+		if err := d.reservePublicIP(c); err != nil {
+			return err
+		}
+		rb.add("public IP "+d.PublicIP, func() error {
+			d.PublicIP = publicIPAuto
+			return nil
+		})
+	}
+
+	// Another machine may have published on the edge gateway between the
+	// check in Create and taking the lock.
+	if err := d.checkNatConflicts(c); err != nil {
+		return err
+	}
+
+	if d.isNsxv() {
+		edge, err := d.nsxvEdge(c)
+		if err != nil {
+			return err
+		}
+		return d.publishNsxv(c, edge, rb)
+	}
+
+	edge, err := d.nsxtEdge(c)
+	if err != nil {
+		return err
+	}
+	return d.publishNsxt(c, edge, network, rb)
+}
+
+// publishNsxv creates the NAT and firewall rules on an NSX-V edge.
+func (d *Driver) publishNsxv(c *vcdConnection, edge *govcd.EdgeGateway, rb *rollback) error {
+	if d.NatMode == natModePortForward {
+		log.Infof("Creating DNAT rules on %s...", d.EdgeGateway)
+		if err := d.forwardPortsNsxv(edge, rb); err != nil {
+			return err
+		}
+		return d.createNsxvFirewall(&c.client.Client, edge, []int{d.ExternalSSHPort, d.ExternalDockerPort}, rb)
+	}
+
+	log.Infof("Creating NAT and Firewall Rules on %s...", d.EdgeGateway)
+	if err := edge.Refresh(); err != nil {
+		return err
+	}
+	knownNat, knownFirewall := nsxvRuleIDs(edge)
+	err := d.retryEdgeUpdate("1:1 NAT mapping", func() error {
+		task, err := edge.Create1to1Mapping(d.PrivateIP, d.PublicIP, d.MachineName)
+		if err != nil {
+			return err
+		}
+		return task.WaitTaskCompletion()
+	})
+	if err != nil {
+		return err
+	}
+	rb.add("1:1 NAT mapping "+d.PublicIP, func() error {
+		if err := d.removeNsxvNatRules(edge); err != nil {
+			return err
+		}
+		return d.removeNsxvFirewall(&c.client.Client, edge)
+	})
+	if err = d.recordNsxvMapping(edge, knownNat, knownFirewall); err != nil {
+		return err
+	}
+
+	return d.createNsxvFirewall(&c.client.Client, edge, d.firewallPorts(), rb)
+}
+
+// publishNsxt creates the NAT and firewall rules on an NSX-T edge.
+func (d *Driver) publishNsxt(c *vcdConnection, edge *govcd.NsxtEdgeGateway, network *types.OrgVDCNetwork, rb *rollback) error {
+	if d.NatMode == natModePortForward {
+		log.Infof("Creating DNAT rules on %s...", d.EdgeGateway)
+		if err := d.forwardPortsNsxt(c.org, edge, network, rb); err != nil {
+			return err
+		}
+		// The rule matches the internal address, hence the internal ports.
+		return d.createNsxtFirewall(c.org, edge, []int{d.SSHPort, d.DockerPort}, rb)
+	}
+
+	log.Infof("Creating NAT and Firewall Rules on %s...", d.EdgeGateway)
+	if err := d.createNsxtNatRules(edge, network, d.oneToOneNatSpecs(), rb); err != nil {
+		return err
+	}
+
+	return d.createNsxtFirewall(c.org, edge, d.firewallPorts(), rb)
+}
+
+// removeNsxvMapping removes the 1:1 mapping of internalIP to d.PublicIP
+// from edge, for machines created before the ledger existed.
+func (d *Driver) removeNsxvMapping(edge *govcd.EdgeGateway, internalIP string) error {
+	return d.retryEdgeUpdate("1:1 NAT mapping removal", func() error {
+		task, err := edge.Remove1to1Mapping(internalIP, d.PublicIP)
+		if err != nil {
+			return err
+		}
+		return task.WaitTaskCompletion()
+	})
+}
+
+// unpublish removes the NAT and firewall rules of the machine in vapp.
+func (d *Driver) unpublish(c *vcdConnection, vapp *govcd.VApp) error {
+	unlock, err := d.lockEdgeGateway(c)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if d.isNsxv() {
+		edge, err := d.nsxvEdge(c)
+		if err != nil {
+			return err
+		}
+
+		if d.NatMode == natModePortForward {
+			log.Infof("Removing DNAT rules on %s...", d.EdgeGateway)
+			if err = d.removeNsxvNatRules(edge); err != nil {
+				return err
+			}
+			return d.removeNsxvFirewall(&c.client.Client, edge)
+		}
+
+		log.Infof("Removing NAT and Firewall Rules on %s...", d.EdgeGateway)
+		if len(d.Ledger.NatRuleIDs) == 0 {
+			// Machines created before the ledger existed did not record
+			// their rules, their mapping is matched by address.
+			vm, err := d.machineVM(vapp)
+			if err != nil {
+				return err
+			}
+			if err = d.removeNsxvMapping(edge, vm.NetworkConnectionSection.NetworkConnection[0].IPAddress); err != nil {
+				return err
+			}
+		} else if err = d.removeNsxvNatRules(edge); err != nil {
+			return err
+		}
+		return d.removeNsxvFirewall(&c.client.Client, edge)
+	}
+
+	adminOrg, err := c.client.GetAdminOrgByName(d.Org)
+	if err != nil {
+		return err
+	}
+
+	if len(d.Ledger.NatRuleIDs) > 0 {
+		edge, err := adminOrg.GetNsxtEdgeGatewayById(d.Ledger.EdgeGatewayID)
+		if err != nil {
+			return err
+		}
+		if err = d.removeNsxtNatRules(edge); err != nil {
+			return err
+		}
+		if err = d.removeNsxtFirewall(edge); err != nil {
+			return err
+		}
+		return d.removeNsxtAppPortProfiles(c.org)
+	}
+
+	// Machines created before the ledger existed are found by rule name.
+	edge, err := adminOrg.GetNsxtEdgeGatewayByName(d.EdgeGateway)
+	if err != nil {
+		return err
+	}
+
+	dnat, err := edge.GetNatRuleByName(d.MachineName + "_dnat")
+	if err != nil {
+		return err
+	}
+	if err = dnat.Delete(); err != nil {
+		return err
+	}
+
+	snat, err := edge.GetNatRuleByName(d.MachineName + "_snat")
+	if err != nil {
+		return err
+	}
+	return snat.Delete()
+}
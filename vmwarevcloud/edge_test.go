@@ -0,0 +1,47 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEdgeTypeFromBacking(t *testing.T) {
+	assert.Equal(t, edgeTypeNsxt, edgeTypeFromBacking("NSXT_FLEXIBLE_SEGMENT"))
+	assert.Equal(t, edgeTypeNsxt, edgeTypeFromBacking("NSXT_SEGMENT"))
+	assert.Equal(t, edgeTypeNsxv, edgeTypeFromBacking("VIRTUAL_WIRE"))
+	assert.Equal(t, "", edgeTypeFromBacking("DV_PORTGROUP"))
+	assert.Equal(t, "", edgeTypeFromBacking(""))
+}
+
+func TestIsNsxv(t *testing.T) {
+	d := &Driver{EdgeType: edgeTypeNsxv}
+	assert.True(t, d.isNsxv())
+
+	d = &Driver{EdgeType: edgeTypeNsxt, VdcEdgeGateway: "vdc"}
+	assert.False(t, d.isNsxv())
+
+	// Machines created before detection follow -vcd-vdcedgegateway.
+	d = &Driver{EdgeType: edgeTypeAuto, VdcEdgeGateway: "vdc"}
+	assert.True(t, d.isNsxv())
+	d = &Driver{}
+	assert.False(t, d.isNsxv())
+}
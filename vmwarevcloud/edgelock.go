@@ -0,0 +1,140 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// edgeLockDir is the directory under StorePath holding edge gateway locks.
+const edgeLockDir = "vcd-locks"
+
+// edgeLockTimeout bounds the wait for another process to release an edge
+// gateway lock.
+const edgeLockTimeout = 15 * time.Minute
+
+// Substrings of vCloud Director errors, lower cased, telling that an edge
+// gateway was changed by someone else, on top of the busy errors.
+var edgeBusyErrors = []string{
+	"conflict",
+	"concurrent",
+	"another operation",
+	"being modified",
+	"being updated",
+}
+
+// isEdgeBusy reports whether err means the edge gateway was busy with, or
+// changed by, a concurrent update.
+func isEdgeBusy(err error) bool {
+	if isBusy(err) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, s := range edgeBusyErrors {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryEdgeUpdate runs update, a read-modify-write of the edge gateway,
+// again while it fails because the edge gateway is busy.
+func (d *Driver) retryEdgeUpdate(what string, update func() error) error {
+	return d.retryPolicy().do(what+" on "+d.EdgeGateway, isEdgeBusy, update)
+}
+
+// edgeLockPath returns the lock file of the edge gateway with ID id.
+func (d *Driver) edgeLockPath(id string) string {
+	name := strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(id)
+	return filepath.Join(d.StorePath, edgeLockDir, name+".lock")
+}
+
+// lockEdgeGateway takes the lock of the edge gateway of the machine, so
+// that docker-machine processes sharing the store update it one at a time.
+// The lock is a file lock, which the system releases when a process dies
+// holding it. The returned function releases the lock.
+func (d *Driver) lockEdgeGateway(c *vcdConnection) (func(), error) {
+	id := d.Ledger.EdgeGatewayID
+	if id == "" {
+		if d.isNsxv() {
+			edge, err := d.nsxvEdge(c)
+			if err != nil {
+				return nil, err
+			}
+			id = edge.EdgeGateway.ID
+		} else {
+			edge, err := d.nsxtEdge(c)
+			if err != nil {
+				return nil, err
+			}
+			id = edge.EdgeGateway.ID
+		}
+	}
+
+	path := d.edgeLockPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to lock edge gateway %s: %s", d.EdgeGateway, err)
+	}
+
+	deadline := time.Now().Add(edgeLockTimeout)
+	waiting := false
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Unable to lock edge gateway %s: %s", d.EdgeGateway, err)
+		}
+		if locked {
+			// The holder is only informative, for processes waiting on it.
+			f.Truncate(0)
+			f.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), d.MachineName)), 0)
+			log.Debugf("Locked edge gateway %s", d.EdgeGateway)
+			return func() {
+				f.Truncate(0)
+				if err := unlockFile(f); err != nil {
+					log.Warnf("Unable to unlock edge gateway %s: %s", d.EdgeGateway, err)
+				}
+				f.Close()
+			}, nil
+		}
+
+		if time.Now().After(deadline) {
+			f.Close()
+			holder, _ := ioutil.ReadFile(path)
+			return nil, fmt.Errorf("Timed out after %s waiting for the lock on edge gateway %s held by %s", edgeLockTimeout, d.EdgeGateway, strings.TrimSpace(string(holder)))
+		}
+		if !waiting {
+			log.Infof("Waiting for another machine to finish updating edge gateway %s...", d.EdgeGateway)
+			waiting = true
+		}
+		time.Sleep(pollInitialInterval + jitter(pollInitialInterval))
+	}
+}
@@ -0,0 +1,73 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsEdgeBusy(t *testing.T) {
+	assert.True(t, isEdgeBusy(errors.New("The entity gateway (com.vmware.vcloud.entity.gateway:1) is busy completing an operation.")))
+	assert.True(t, isEdgeBusy(errors.New("error reconfiguring Edge Gateway: 409 Conflict")))
+	assert.False(t, isEdgeBusy(errors.New("Firewall rule m_allow is missing")))
+}
+
+func TestRetryEdgeUpdate(t *testing.T) {
+	d := NewDriver("m", "path").(*Driver)
+
+	calls := 0
+	err := d.retryEdgeUpdate("test", func() error {
+		calls++
+		return errors.New("bad request")
+	})
+	assert.EqualError(t, err, "bad request")
+	assert.Equal(t, 1, calls)
+}
+
+func TestLockEdgeGateway(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vcd-lock")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d := NewDriver("m", dir).(*Driver)
+	d.Ledger.EdgeGatewayID = "urn:vcloud:gateway:1"
+	path := d.edgeLockPath(d.Ledger.EdgeGatewayID)
+
+	unlock, err := d.lockEdgeGateway(nil)
+	assert.NoError(t, err)
+
+	// Another process opening the lock file cannot take the lock.
+	other, err := os.OpenFile(path, os.O_RDWR, 0600)
+	assert.NoError(t, err)
+	defer other.Close()
+	locked, err := tryLockFile(other)
+	assert.NoError(t, err)
+	assert.False(t, locked)
+
+	unlock()
+	locked, err = tryLockFile(other)
+	assert.NoError(t, err)
+	assert.True(t, locked)
+	assert.NoError(t, unlockFile(other))
+}
@@ -0,0 +1,250 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// parseAllowedPorts parses the -vcd-allowed-port values.
+func parseAllowedPorts(values []string) ([]int, error) {
+	ports := make([]int, 0, len(values))
+	for _, value := range values {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("Invalid -vcd-allowed-port %q, expected a TCP port", value)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// checkAllowedCIDRs validates the -vcd-allowed-cidr values, IPv4 CIDRs or
+// single IPv4 addresses. The firewall rules only admit IPv4 traffic, as
+// the public IP of the machine is an IPv4 address.
+func checkAllowedCIDRs(values []string) error {
+	for _, value := range values {
+		ip := net.ParseIP(value)
+		if cidrIP, _, err := net.ParseCIDR(value); err == nil {
+			ip = cidrIP
+		}
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("Invalid -vcd-allowed-cidr %q, expected an IPv4 CIDR or address", value)
+		}
+	}
+	return nil
+}
+
+// firewallPorts returns the TCP ports of the machine opened on the edge
+// gateway in 1to1 NAT mode: SSH, Docker TLS and the -vcd-allowed-port
+// ones.
+func (d *Driver) firewallPorts() []int {
+	// AllowedPorts were validated by SetConfigFromFlags.
+	ports, _ := parseAllowedPorts(d.AllowedPorts)
+	return append([]int{d.SSHPort, d.DockerPort}, ports...)
+}
+
+// createNsxtFirewall adds a gateway firewall rule to edge allowing ports
+// of d.PrivateIP from the allowed CIDRs, or from anywhere when none is
+// given. NAT rules match it on their internal address.
+func (d *Driver) createNsxtFirewall(org *govcd.Org, edge *govcd.NsxtEdgeGateway, ports []int, rb *rollback) error {
+	edgeRef := &types.OpenApiReference{ID: edge.EdgeGateway.ID}
+
+	ipSet := func(suffix string, addresses []string) (types.OpenApiReference, error) {
+		group, err := edge.CreateNsxtFirewallGroup(&types.NsxtFirewallGroup{
+			Name:           d.MachineName + suffix,
+			Description:    d.MachineName,
+			IpAddresses:    addresses,
+			EdgeGatewayRef: edgeRef,
+			Type:           types.FirewallGroupTypeIpSet,
+		})
+		if err != nil {
+			return types.OpenApiReference{}, err
+		}
+		rb.add("IP set "+group.NsxtFirewallGroup.Name, group.Delete)
+		d.Ledger.FirewallGroupIDs = append(d.Ledger.FirewallGroupIDs, group.NsxtFirewallGroup.ID)
+		return types.OpenApiReference{ID: group.NsxtFirewallGroup.ID}, nil
+	}
+
+	rule := &types.NsxtFirewallRule{
+		Name:       d.MachineName + "_allow",
+		Action:     "ALLOW",
+		Enabled:    true,
+		IpProtocol: "IPV4",
+		Direction:  "IN",
+	}
+
+	destination, err := ipSet("_dst", []string{d.PrivateIP})
+	if err != nil {
+		return err
+	}
+	rule.DestinationFirewallGroups = []types.OpenApiReference{destination}
+
+	if len(d.AllowedCIDRs) > 0 {
+		source, err := ipSet("_src", d.AllowedCIDRs)
+		if err != nil {
+			return err
+		}
+		rule.SourceFirewallGroups = []types.OpenApiReference{source}
+	}
+
+	for _, port := range ports {
+		profile, err := d.tcpPortProfile(org, edge, port, rb)
+		if err != nil {
+			return err
+		}
+		rule.ApplicationPortProfiles = append(rule.ApplicationPortProfiles, types.OpenApiReference{ID: profile.NsxtAppPortProfile.ID})
+	}
+
+	log.Infof("Creating firewall rule %s on %s...", rule.Name, d.EdgeGateway)
+	var firewall *govcd.NsxtFirewall
+	err = d.retryEdgeUpdate("firewall rule "+rule.Name, func() error {
+		current, err := edge.GetNsxtFirewall()
+		if err != nil {
+			return err
+		}
+		rules := append(current.NsxtFirewallRuleContainer.UserDefinedRules, rule)
+		firewall, err = edge.UpdateNsxtFirewall(&types.NsxtFirewallRuleContainer{UserDefinedRules: rules})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, created := range firewall.NsxtFirewallRuleContainer.UserDefinedRules {
+		if created.Name == rule.Name {
+			id := created.ID
+			rb.add("firewall rule "+rule.Name, func() error {
+				return firewall.DeleteRuleById(id)
+			})
+			d.Ledger.FirewallRuleIDs = append(d.Ledger.FirewallRuleIDs, id)
+			return nil
+		}
+	}
+	return fmt.Errorf("Firewall rule %s is missing on %s after creation", rule.Name, d.EdgeGateway)
+}
+
+// mimeEdgeServices is the content type of edge gateway service updates.
+const mimeEdgeServices = "application/vnd.vmware.admin.edgeGatewayServiceConfiguration+xml"
+
+// nsxvFirewallRules returns the NSX-V firewall rules allowing ports of
+// d.PublicIP from each allowed CIDR, or from anywhere when none is given.
+func (d *Driver) nsxvFirewallRules(ports []int) []*types.FirewallRule {
+	sources := d.AllowedCIDRs
+	if len(sources) == 0 {
+		sources = []string{"Any"}
+	}
+
+	var rules []*types.FirewallRule
+	for _, port := range ports {
+		for _, source := range sources {
+			rules = append(rules, &types.FirewallRule{
+				Description:          d.MachineName,
+				IsEnabled:            true,
+				Policy:               "allow",
+				Protocols:            &types.FirewallRuleProtocols{TCP: true},
+				DestinationPortRange: strconv.Itoa(port),
+				DestinationIP:        d.PublicIP,
+				SourcePortRange:      "Any",
+				SourceIP:             source,
+			})
+		}
+	}
+	return rules
+}
+
+// isCatchAllInbound reports whether rule is the inbound rule allowing
+// everything to d.PublicIP that Create1to1Mapping adds.
+func (d *Driver) isCatchAllInbound(rule *types.FirewallRule) bool {
+	return rule.Description == d.MachineName && rule.Policy == "allow" &&
+		rule.Protocols != nil && rule.Protocols.Any && rule.DestinationIP == d.PublicIP
+}
+
+// createNsxvFirewall adds the NSX-V firewall rules for ports of
+// d.PublicIP to edge and records their IDs. The catch-all inbound rule of
+// a 1:1 mapping is dropped, so that only these ports stay open.
+func (d *Driver) createNsxvFirewall(client *govcd.Client, edge *govcd.EdgeGateway, ports []int, rb *rollback) error {
+	log.Infof("Creating firewall rules on %s...", d.EdgeGateway)
+	existing := map[string]bool{}
+	err := d.retryEdgeUpdate("firewall rules", func() error {
+		if err := edge.Refresh(); err != nil {
+			return err
+		}
+		services := edge.EdgeGateway.Configuration.EdgeGatewayServiceConfiguration
+		if services == nil || services.FirewallService == nil {
+			return fmt.Errorf("Edge gateway %s has no firewall service", d.EdgeGateway)
+		}
+
+		var rules []*types.FirewallRule
+		for _, rule := range services.FirewallService.FirewallRule {
+			existing[rule.ID] = true
+			if !d.isCatchAllInbound(rule) {
+				rules = append(rules, rule)
+			}
+		}
+		rules = append(rules, d.nsxvFirewallRules(ports)...)
+
+		return configureNsxvFirewall(client, edge, services.FirewallService, rules)
+	})
+	if err != nil {
+		return err
+	}
+	rb.add("firewall rules on "+d.EdgeGateway, func() error {
+		return d.removeNsxvFirewall(client, edge)
+	})
+
+	if err := edge.Refresh(); err != nil {
+		return err
+	}
+	for _, rule := range edge.EdgeGateway.Configuration.EdgeGatewayServiceConfiguration.FirewallService.FirewallRule {
+		if !existing[rule.ID] && rule.Description == d.MachineName {
+			d.Ledger.FirewallRuleIDs = appendID(d.Ledger.FirewallRuleIDs, rule.ID)
+		}
+	}
+	return nil
+}
+
+// configureNsxvFirewall replaces the rules of the firewall service of edge,
+// keeping its other settings.
+func configureNsxvFirewall(client *govcd.Client, edge *govcd.EdgeGateway, service *types.FirewallService, rules []*types.FirewallRule) error {
+	config := &types.EdgeGatewayServiceConfiguration{
+		Xmlns: types.XMLNamespaceVCloud,
+		FirewallService: &types.FirewallService{
+			IsEnabled:        service.IsEnabled,
+			DefaultAction:    service.DefaultAction,
+			LogDefaultAction: service.LogDefaultAction,
+			FirewallRule:     rules,
+		},
+	}
+
+	task, err := client.ExecuteTaskRequest(edge.EdgeGateway.HREF+"/action/configureServices", http.MethodPost,
+		mimeEdgeServices, "error reconfiguring Edge Gateway: %s", config)
+	if err != nil {
+		return err
+	}
+	return task.WaitTaskCompletion()
+}
@@ -0,0 +1,70 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestFirewallPorts(t *testing.T) {
+	d := NewDriver("default", "path").(*Driver)
+	d.AllowedPorts = []string{"6443", "9345"}
+	assert.Equal(t, []int{22, 2376, 6443, 9345}, d.firewallPorts())
+
+	for _, value := range []string{"", "ssh", "0", "70000"} {
+		_, err := parseAllowedPorts([]string{value})
+		assert.Error(t, err, value)
+	}
+}
+
+func TestCheckAllowedCIDRs(t *testing.T) {
+	assert.NoError(t, checkAllowedCIDRs([]string{"198.51.100.0/24", "203.0.113.7"}))
+	assert.Error(t, checkAllowedCIDRs([]string{"198.51.100.0/33"}))
+	assert.Error(t, checkAllowedCIDRs([]string{"2001:db8::/32"}))
+	assert.Error(t, checkAllowedCIDRs([]string{"2001:db8::7"}))
+	assert.Error(t, checkAllowedCIDRs([]string{"office"}))
+}
+
+func TestNsxvFirewallRules(t *testing.T) {
+	d := NewDriver("default", "path").(*Driver)
+	d.PublicIP = "203.0.113.10"
+
+	rules := d.nsxvFirewallRules([]int{22, 2376})
+	assert.Len(t, rules, 2)
+	assert.Equal(t, "Any", rules[0].SourceIP)
+	assert.Equal(t, "2376", rules[1].DestinationPortRange)
+	assert.True(t, rules[1].Protocols.TCP)
+	assert.False(t, d.isCatchAllInbound(rules[0]))
+
+	d.AllowedCIDRs = []string{"198.51.100.0/24", "192.0.2.7"}
+	rules = d.nsxvFirewallRules([]int{22, 2376})
+	assert.Len(t, rules, 4)
+	assert.Equal(t, "192.0.2.7", rules[3].SourceIP)
+	assert.Equal(t, "203.0.113.10", rules[3].DestinationIP)
+
+	assert.True(t, d.isCatchAllInbound(&types.FirewallRule{
+		Description:   "default",
+		Policy:        "allow",
+		Protocols:     &types.FirewallRuleProtocols{Any: true},
+		DestinationIP: "203.0.113.10",
+	}))
+}
@@ -0,0 +1,152 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+// dualStackAPIVersion is the first API version (vCloud Director 10.2) with
+// secondary IP addresses on network connections.
+const dualStackAPIVersion = "35.0"
+
+// dualStackConnectionSection is types.NetworkConnectionSection with the
+// secondary address fields, which the go-vcloud-director types lack.
+type dualStackConnectionSection struct {
+	XMLName xml.Name `xml:"NetworkConnectionSection"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	Ovf     string   `xml:"xmlns:ovf,attr,omitempty"`
+
+	Info                          string                 `xml:"ovf:Info"`
+	HREF                          string                 `xml:"href,attr,omitempty"`
+	Type                          string                 `xml:"type,attr,omitempty"`
+	PrimaryNetworkConnectionIndex int                    `xml:"PrimaryNetworkConnectionIndex"`
+	NetworkConnection             []*dualStackConnection `xml:"NetworkConnection,omitempty"`
+	Link                          []*types.Link          `xml:"Link,omitempty"`
+}
+
+// dualStackConnection is types.NetworkConnection with the secondary address
+// fields, in the order of the vCloud Director schema.
+type dualStackConnection struct {
+	Network                          string `xml:"network,attr"`
+	NeedsCustomization               bool   `xml:"needsCustomization,attr,omitempty"`
+	NetworkConnectionIndex           int    `xml:"NetworkConnectionIndex"`
+	IPAddress                        string `xml:"IpAddress,omitempty"`
+	IPType                           string `xml:"IpType,omitempty"`
+	SecondaryIPAddress               string `xml:"SecondaryIpAddress,omitempty"`
+	SecondaryIPType                  string `xml:"SecondaryIpType,omitempty"`
+	ExternalIPAddress                string `xml:"ExternalIpAddress,omitempty"`
+	IsConnected                      bool   `xml:"IsConnected"`
+	MACAddress                       string `xml:"MACAddress,omitempty"`
+	IPAddressAllocationMode          string `xml:"IpAddressAllocationMode"`
+	SecondaryIPAddressAllocationMode string `xml:"SecondaryIpAddressAllocationMode,omitempty"`
+	NetworkAdapterType               string `xml:"NetworkAdapterType,omitempty"`
+}
+
+// hasIPv6Scope reports whether network has an IPv6 subnet.
+func hasIPv6Scope(network *types.OrgVDCNetwork) bool {
+	if network.Configuration == nil || network.Configuration.IPScopes == nil {
+		return false
+	}
+	for _, scope := range network.Configuration.IPScopes.IPScope {
+		if ip := net.ParseIP(scope.Gateway); ip != nil && ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// dualStackSection reads the network connections of vm with their
+// secondary addresses.
+func dualStackSection(client *govcd.Client, vm *govcd.VM) (*dualStackConnectionSection, error) {
+	if !client.APIVCDMaxVersionIs(">= " + dualStackAPIVersion) {
+		return nil, fmt.Errorf("IPv6 addresses need vCloud Director 10.2 or later")
+	}
+
+	section := &dualStackConnectionSection{}
+	_, err := client.ExecuteRequestWithApiVersion(vm.VM.HREF+"/networkConnectionSection/", http.MethodGet,
+		types.MimeNetworkConnectionSection, "error retrieving network connection: %s", nil, section, dualStackAPIVersion)
+	if err != nil {
+		return nil, err
+	}
+	return section, nil
+}
+
+// allocateIPv6 asks for a secondary IPv6 address from the pool on every
+// adapter of vm whose network, looked up in networks, has an IPv6 subnet.
+// It fails when none of the adapters can get one.
+func allocateIPv6(client *govcd.Client, vm *govcd.VM, networks map[string]*types.OrgVDCNetwork) error {
+	section, err := dualStackSection(client, vm)
+	if err != nil {
+		return err
+	}
+
+	allocated := 0
+	for _, connection := range section.NetworkConnection {
+		network, ok := networks[connection.Network]
+		if !ok || !hasIPv6Scope(network) {
+			continue
+		}
+		connection.SecondaryIPAddressAllocationMode = types.IPAllocationModePool
+		connection.NeedsCustomization = true
+		allocated++
+	}
+	if allocated == 0 {
+		return fmt.Errorf("None of the networks of %s has an IPv6 subnet", vm.VM.Name)
+	}
+
+	section.Ovf = types.XMLNamespaceOVF
+	task, err := client.ExecuteTaskRequestWithApiVersion(vm.VM.HREF+"/networkConnectionSection/", http.MethodPut,
+		types.MimeNetworkConnectionSection, "error updating network connection: %s", section, dualStackAPIVersion)
+	if err != nil {
+		return err
+	}
+	return task.WaitTaskCompletion()
+}
+
+// nicIPv6Address returns the IPv6 address, primary or secondary, of the
+// adapter with the given connection index, or "" while it has none.
+func nicIPv6Address(section *dualStackConnectionSection, index int) string {
+	for _, connection := range section.NetworkConnection {
+		if connection.NetworkConnectionIndex != index {
+			continue
+		}
+		for _, addr := range []string{connection.IPAddress, connection.SecondaryIPAddress} {
+			if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+				return addr
+			}
+		}
+	}
+	return ""
+}
+
+// dockerURL returns the Docker daemon URL for host, bracketing IPv6
+// addresses. A host given already bracketed is not bracketed twice.
+func dockerURL(host string, port int) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return "tcp://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,74 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestHasIPv6Scope(t *testing.T) {
+	network := &types.OrgVDCNetwork{Name: "k8s-net", Configuration: &types.NetworkConfiguration{
+		IPScopes: &types.IPScopes{IPScope: []*types.IPScope{{Gateway: "192.168.10.1", Netmask: "255.255.255.0"}}},
+	}}
+	assert.False(t, hasIPv6Scope(network))
+
+	network.Configuration.IPScopes.IPScope = append(network.Configuration.IPScopes.IPScope, &types.IPScope{Gateway: "2001:db8::1"})
+	assert.True(t, hasIPv6Scope(network))
+
+	assert.False(t, hasIPv6Scope(&types.OrgVDCNetwork{Name: "empty"}))
+}
+
+func TestNICIPv6Address(t *testing.T) {
+	body := `<NetworkConnectionSection xmlns="http://www.vmware.com/vcloud/v1.5">
+	<PrimaryNetworkConnectionIndex>0</PrimaryNetworkConnectionIndex>
+	<NetworkConnection network="k8s-net">
+		<NetworkConnectionIndex>0</NetworkConnectionIndex>
+		<IpAddress>192.168.10.20</IpAddress>
+		<IpType>IPV4</IpType>
+		<SecondaryIpAddress>2001:db8::20</SecondaryIpAddress>
+		<SecondaryIpType>IPV6</SecondaryIpType>
+		<IsConnected>true</IsConnected>
+		<IpAddressAllocationMode>POOL</IpAddressAllocationMode>
+		<SecondaryIpAddressAllocationMode>POOL</SecondaryIpAddressAllocationMode>
+	</NetworkConnection>
+	<NetworkConnection network="v6-net">
+		<NetworkConnectionIndex>1</NetworkConnectionIndex>
+		<IpAddress>2001:db8:1::5</IpAddress>
+		<IsConnected>true</IsConnected>
+		<IpAddressAllocationMode>POOL</IpAddressAllocationMode>
+	</NetworkConnection>
+</NetworkConnectionSection>`
+
+	section := &dualStackConnectionSection{}
+	assert.NoError(t, xml.Unmarshal([]byte(body), section))
+
+	assert.Equal(t, "2001:db8::20", nicIPv6Address(section, 0))
+	assert.Equal(t, "2001:db8:1::5", nicIPv6Address(section, 1))
+	assert.Equal(t, "", nicIPv6Address(section, 2))
+}
+
+func TestDockerURL(t *testing.T) {
+	assert.Equal(t, "tcp://192.168.10.20:2376", dockerURL("192.168.10.20", 2376))
+	assert.Equal(t, "tcp://[2001:db8::20]:2376", dockerURL("2001:db8::20", 2376))
+	assert.Equal(t, "tcp://[2001:db8::20]:2376", dockerURL("[2001:db8::20]", 2376))
+}
@@ -0,0 +1,259 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"fmt"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Ledger records, next to VAppID, every vCloud Director object created for
+// a machine. It is persisted in the machine config so that Remove and
+// cleanup work on exact IDs instead of names and current IP addresses.
+type Ledger struct {
+	VMID            string   `json:",omitempty"`
+	EdgeGatewayID   string   `json:",omitempty"`
+	NatRuleIDs      []string `json:",omitempty"`
+	FirewallRuleIDs []string `json:",omitempty"`
+	// FirewallGroupIDs are the NSX-T IP sets of the firewall rules.
+	FirewallGroupIDs []string `json:",omitempty"`
+	// AppPortProfileIDs are the NSX-T application port profiles of the
+	// NAT and firewall rules.
+	AppPortProfileIDs []string `json:",omitempty"`
+}
+
+// appendID appends id to ids unless it is already there.
+func appendID(ids []string, id string) []string {
+	for _, existing := range ids {
+		if existing == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+// machineVM returns the VM of the machine in vapp, found by the ID recorded
+// in the ledger. Machines created before the ledger existed hold a single
+// VM.
+func (d *Driver) machineVM(vapp *govcd.VApp) (*types.Vm, error) {
+	if vapp.VApp.Children == nil || len(vapp.VApp.Children.VM) == 0 {
+		return nil, fmt.Errorf("vApp %s has no VM", vapp.VApp.Name)
+	}
+	if d.Ledger.VMID == "" {
+		return vapp.VApp.Children.VM[0], nil
+	}
+
+	for _, vm := range vapp.VApp.Children.VM {
+		if vm.ID == d.Ledger.VMID {
+			return vm, nil
+		}
+	}
+	return nil, fmt.Errorf("VM %s of %s is not in vApp %s", d.Ledger.VMID, d.MachineName, vapp.VApp.Name)
+}
+
+// nsxvRuleIDs returns the IDs of the NAT and of the firewall rules of
+// edge.
+func nsxvRuleIDs(edge *govcd.EdgeGateway) (map[string]bool, map[string]bool) {
+	nat, firewall := map[string]bool{}, map[string]bool{}
+	services := edge.EdgeGateway.Configuration.EdgeGatewayServiceConfiguration
+	if services == nil {
+		return nat, firewall
+	}
+	if services.NatService != nil {
+		for _, rule := range services.NatService.NatRule {
+			nat[rule.ID] = true
+		}
+	}
+	if services.FirewallService != nil {
+		for _, rule := range services.FirewallService.FirewallRule {
+			firewall[rule.ID] = true
+		}
+	}
+	return nat, firewall
+}
+
+// recordNsxvMapping stores the IDs of the NAT and firewall rules that
+// Create1to1Mapping added to edge with the machine name as description.
+// knownNat and knownFirewall are the rule IDs from before the mapping, so
+// that rules of other tools with the same description are left out.
+func (d *Driver) recordNsxvMapping(edge *govcd.EdgeGateway, knownNat, knownFirewall map[string]bool) error {
+	if err := edge.Refresh(); err != nil {
+		return err
+	}
+
+	d.Ledger.EdgeGatewayID = edge.EdgeGateway.ID
+
+	services := edge.EdgeGateway.Configuration.EdgeGatewayServiceConfiguration
+	if services == nil {
+		return nil
+	}
+	if services.NatService != nil {
+		for _, rule := range services.NatService.NatRule {
+			if !knownNat[rule.ID] && rule.Description == d.MachineName {
+				d.Ledger.NatRuleIDs = appendID(d.Ledger.NatRuleIDs, rule.ID)
+			}
+		}
+	}
+	if services.FirewallService != nil {
+		for _, rule := range services.FirewallService.FirewallRule {
+			if !knownFirewall[rule.ID] && rule.Description == d.MachineName {
+				d.Ledger.FirewallRuleIDs = appendID(d.Ledger.FirewallRuleIDs, rule.ID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeNsxtNatRules deletes the NSX-T NAT rules recorded in the ledger.
+// Rules that are already gone are skipped.
+func (d *Driver) removeNsxtNatRules(edge *govcd.NsxtEdgeGateway) error {
+	for _, id := range d.Ledger.NatRuleIDs {
+		rule, err := edge.GetNatRuleById(id)
+		if govcd.ContainsNotFound(err) {
+			log.Debugf("NAT rule %s is already gone", id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Removing NAT rule %s...", rule.NsxtNatRule.Name)
+		if err = d.retryEdgeUpdate("NAT rule "+rule.NsxtNatRule.Name, rule.Delete); err != nil {
+			return err
+		}
+	}
+
+	d.Ledger.NatRuleIDs = nil
+	return nil
+}
+
+// removeNsxtFirewall deletes the NSX-T firewall rules and then the IP sets
+// recorded in the ledger. Objects that are already gone are skipped.
+func (d *Driver) removeNsxtFirewall(edge *govcd.NsxtEdgeGateway) error {
+	if len(d.Ledger.FirewallRuleIDs) > 0 {
+		firewall, err := edge.GetNsxtFirewall()
+		if err != nil {
+			return err
+		}
+		for _, id := range d.Ledger.FirewallRuleIDs {
+			log.Infof("Removing firewall rule %s...", id)
+			err = d.retryEdgeUpdate("firewall rule "+id, func() error { return firewall.DeleteRuleById(id) })
+			if err != nil && !govcd.ContainsNotFound(err) {
+				return err
+			}
+		}
+		d.Ledger.FirewallRuleIDs = nil
+	}
+
+	for _, id := range d.Ledger.FirewallGroupIDs {
+		group, err := edge.GetNsxtFirewallGroupById(id)
+		if govcd.ContainsNotFound(err) {
+			log.Debugf("IP set %s is already gone", id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Removing IP set %s...", group.NsxtFirewallGroup.Name)
+		if err = group.Delete(); err != nil {
+			return err
+		}
+	}
+	d.Ledger.FirewallGroupIDs = nil
+
+	return nil
+}
+
+// removeNsxvFirewall deletes the NSX-V firewall rules recorded in the
+// ledger. Rules that are already gone are skipped.
+func (d *Driver) removeNsxvFirewall(client *govcd.Client, edge *govcd.EdgeGateway) error {
+	if len(d.Ledger.FirewallRuleIDs) == 0 {
+		return nil
+	}
+
+	recorded := map[string]bool{}
+	for _, id := range d.Ledger.FirewallRuleIDs {
+		recorded[id] = true
+	}
+
+	err := d.retryEdgeUpdate("firewall rule removal", func() error {
+		if err := edge.Refresh(); err != nil {
+			return err
+		}
+		services := edge.EdgeGateway.Configuration.EdgeGatewayServiceConfiguration
+		if services == nil || services.FirewallService == nil {
+			return nil
+		}
+
+		var rules []*types.FirewallRule
+		for _, rule := range services.FirewallService.FirewallRule {
+			if !recorded[rule.ID] {
+				rules = append(rules, rule)
+			}
+		}
+		if len(rules) == len(services.FirewallService.FirewallRule) {
+			return nil
+		}
+
+		log.Infof("Removing firewall rules on %s...", d.EdgeGateway)
+		return configureNsxvFirewall(client, edge, services.FirewallService, rules)
+	})
+	if err != nil {
+		return err
+	}
+
+	d.Ledger.FirewallRuleIDs = nil
+	return nil
+}
+
+// removeNsxvNatRules deletes the NSX-V NAT rules recorded in the ledger.
+// Rules that are already gone are skipped.
+func (d *Driver) removeNsxvNatRules(edge *govcd.EdgeGateway) error {
+	if err := edge.Refresh(); err != nil {
+		return err
+	}
+
+	existing := map[string]bool{}
+	if services := edge.EdgeGateway.Configuration.EdgeGatewayServiceConfiguration; services != nil && services.NatService != nil {
+		for _, rule := range services.NatService.NatRule {
+			existing[rule.ID] = true
+		}
+	}
+
+	for _, id := range d.Ledger.NatRuleIDs {
+		if !existing[id] {
+			log.Debugf("NAT rule %s is already gone", id)
+			continue
+		}
+
+		log.Infof("Removing NAT rule %s...", id)
+		if err := d.retryEdgeUpdate("NAT rule "+id, func() error { return edge.RemoveNATRule(id) }); err != nil {
+			return err
+		}
+	}
+
+	d.Ledger.NatRuleIDs = nil
+	return nil
+}
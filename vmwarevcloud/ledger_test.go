@@ -0,0 +1,102 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"encoding/json"
+	"testing"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendID(t *testing.T) {
+	ids := appendID(nil, "a")
+	ids = appendID(ids, "b")
+	ids = appendID(ids, "a")
+	assert.Equal(t, []string{"a", "b"}, ids)
+}
+
+func TestLedgerRoundTrip(t *testing.T) {
+	driver := NewDriver("default", "path").(*Driver)
+	driver.Ledger = Ledger{
+		VMID:              "urn:vcloud:vm:1",
+		EdgeGatewayID:     "urn:vcloud:gateway:1",
+		NatRuleIDs:        []string{"65537", "65538"},
+		FirewallRuleIDs:   []string{"131073"},
+		FirewallGroupIDs:  []string{"urn:vcloud:firewallGroup:1"},
+		AppPortProfileIDs: []string{"urn:vcloud:applicationPortProfile:1"},
+	}
+
+	data, err := json.Marshal(driver)
+	assert.NoError(t, err)
+
+	loaded := NewDriver("default", "path").(*Driver)
+	assert.NoError(t, json.Unmarshal(data, loaded))
+	assert.Equal(t, driver.Ledger, loaded.Ledger)
+
+	// An empty ledger, as in machines created before it existed, is
+	// stored without any ID.
+	data, err = json.Marshal(Ledger{})
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(data))
+}
+
+func TestMachineVM(t *testing.T) {
+	driver := NewDriver("default", "path").(*Driver)
+	vapp := &govcd.VApp{VApp: &types.VApp{Name: "default"}}
+
+	_, err := driver.machineVM(vapp)
+	assert.Error(t, err)
+
+	vapp.VApp.Children = &types.VAppChildren{VM: []*types.Vm{
+		{ID: "urn:vcloud:vm:1"},
+		{ID: "urn:vcloud:vm:2"},
+	}}
+
+	vm, err := driver.machineVM(vapp)
+	assert.NoError(t, err)
+	assert.Equal(t, "urn:vcloud:vm:1", vm.ID)
+
+	driver.Ledger.VMID = "urn:vcloud:vm:2"
+	vm, err = driver.machineVM(vapp)
+	assert.NoError(t, err)
+	assert.Equal(t, "urn:vcloud:vm:2", vm.ID)
+
+	driver.Ledger.VMID = "urn:vcloud:vm:3"
+	_, err = driver.machineVM(vapp)
+	assert.Error(t, err)
+}
+
+func TestNsxvRuleIDs(t *testing.T) {
+	edge := &govcd.EdgeGateway{EdgeGateway: &types.EdgeGateway{Configuration: &types.GatewayConfiguration{}}}
+	nat, firewall := nsxvRuleIDs(edge)
+	assert.Empty(t, nat)
+	assert.Empty(t, firewall)
+
+	edge.EdgeGateway.Configuration.EdgeGatewayServiceConfiguration = &types.GatewayFeatures{
+		NatService:      &types.NatService{NatRule: []*types.NatRule{{ID: "65537"}, {ID: "65538"}}},
+		FirewallService: &types.FirewallService{FirewallRule: []*types.FirewallRule{{ID: "65537"}}},
+	}
+	nat, firewall = nsxvRuleIDs(edge)
+	assert.Equal(t, map[string]bool{"65537": true, "65538": true}, nat)
+	assert.Equal(t, map[string]bool{"65537": true}, firewall)
+}
@@ -0,0 +1,319 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"fmt"
+	"net"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// nsxtNatRuleSpec is a NAT rule the driver creates on an NSX-T edge
+// gateway. For both SNAT and DNAT rules external is the address on the
+// edge gateway uplink and internal the address of the machine.
+type nsxtNatRuleSpec struct {
+	name          string
+	ruleType      string
+	external      string
+	internal      string
+	externalPort  string
+	portProfileID string
+	firewallMatch string
+}
+
+// oneToOneNatSpecs returns the SNAT and DNAT rules mapping the public IP of
+// the machine to its private IP. Outbound traffic is not filtered by the
+// driver, inbound traffic goes through the gateway firewall.
+func (d *Driver) oneToOneNatSpecs() []nsxtNatRuleSpec {
+	return []nsxtNatRuleSpec{
+		{
+			name:          d.MachineName + "_snat",
+			ruleType:      types.NsxtNatRuleTypeSnat,
+			external:      d.PublicIP,
+			internal:      d.PrivateIP,
+			firewallMatch: types.NsxtNatRuleFirewallMatchBypass,
+		},
+		{
+			name:          d.MachineName + "_dnat",
+			ruleType:      types.NsxtNatRuleTypeDnat,
+			external:      d.PublicIP,
+			internal:      d.PrivateIP,
+			firewallMatch: types.NsxtNatRuleFirewallMatchInternalAddress,
+		},
+	}
+}
+
+// validate checks that the internal address of s is on network and that
+// its external address is allocated to the edge gateway uplinks.
+func (s nsxtNatRuleSpec) validate(network *types.OrgVDCNetwork, allocated map[string]bool) error {
+	switch s.ruleType {
+	case types.NsxtNatRuleTypeDnat:
+	case types.NsxtNatRuleTypeSnat:
+		if s.externalPort != "" || s.portProfileID != "" {
+			return fmt.Errorf("SNAT rule %s cannot translate ports", s.name)
+		}
+	default:
+		return fmt.Errorf("NAT rule %s has unsupported type %q", s.name, s.ruleType)
+	}
+
+	if err := checkStaticIP(network, s.internal); err != nil {
+		return fmt.Errorf("Invalid internal address of NAT rule %s: %s", s.name, err)
+	}
+
+	if net.ParseIP(s.external) == nil {
+		return fmt.Errorf("Invalid external address %q of NAT rule %s", s.external, s.name)
+	}
+	if !allocated[s.external] {
+		return fmt.Errorf("External address %s of NAT rule %s is not allocated to the edge gateway uplinks", s.external, s.name)
+	}
+	return nil
+}
+
+// definition returns the NSX-T NAT rule for s.
+func (s nsxtNatRuleSpec) definition(description string) *types.NsxtNatRule {
+	rule := &types.NsxtNatRule{
+		Name:              s.name,
+		Description:       description,
+		Enabled:           true,
+		RuleType:          s.ruleType,
+		ExternalAddresses: s.external,
+		InternalAddresses: s.internal,
+		DnatExternalPort:  s.externalPort,
+		FirewallMatch:     s.firewallMatch,
+	}
+	if s.portProfileID != "" {
+		rule.ApplicationPortProfile = &types.OpenApiReference{ID: s.portProfileID}
+	}
+	return rule
+}
+
+// check compares rule, as read back from the edge gateway, with s.
+func (s nsxtNatRuleSpec) check(rule *types.NsxtNatRule) error {
+	var profileID string
+	if rule.ApplicationPortProfile != nil {
+		profileID = rule.ApplicationPortProfile.ID
+	}
+
+	for _, field := range []struct{ name, got, want string }{
+		{"name", rule.Name, s.name},
+		{"type", rule.RuleType, s.ruleType},
+		{"external address", rule.ExternalAddresses, s.external},
+		{"internal address", rule.InternalAddresses, s.internal},
+		{"external port", rule.DnatExternalPort, s.externalPort},
+		{"application port profile", profileID, s.portProfileID},
+		{"firewall match", rule.FirewallMatch, s.firewallMatch},
+	} {
+		if field.got != field.want {
+			return fmt.Errorf("NAT rule %s has %s %q instead of %q", s.name, field.name, field.got, field.want)
+		}
+	}
+	if !rule.Enabled {
+		return fmt.Errorf("NAT rule %s is disabled", s.name)
+	}
+	return nil
+}
+
+// createNsxtNatRules validates specs against network and the uplinks of
+// edge, creates the rules and reads each one back to check that the edge
+// gateway holds what was asked for.
+func (d *Driver) createNsxtNatRules(edge *govcd.NsxtEdgeGateway, network *types.OrgVDCNetwork, specs []nsxtNatRuleSpec, rb *rollback) error {
+	allocated := map[string]bool{}
+	ips, err := nsxtSubAllocatedIPs(edge, allocated)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		allocated[ip] = true
+	}
+
+	for _, spec := range specs {
+		if err = spec.validate(network, allocated); err != nil {
+			return err
+		}
+	}
+
+	d.Ledger.EdgeGatewayID = edge.EdgeGateway.ID
+	for _, spec := range specs {
+		log.Debugf("Creating %s rule %s: %s <-> %s", spec.ruleType, spec.name, spec.external, spec.internal)
+		var rule *govcd.NsxtNatRule
+		err = d.retryEdgeUpdate("NAT rule "+spec.name, func() error {
+			rule, err = edge.CreateNatRule(spec.definition(d.MachineName))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		rb.add("NAT rule "+spec.name, rule.Delete)
+		d.Ledger.NatRuleIDs = append(d.Ledger.NatRuleIDs, rule.NsxtNatRule.ID)
+
+		created, err := edge.GetNatRuleById(rule.NsxtNatRule.ID)
+		if err != nil {
+			return fmt.Errorf("Unable to read back NAT rule %s: %s", spec.name, err)
+		}
+		if err = spec.check(created.NsxtNatRule); err != nil {
+			return fmt.Errorf("NAT rule on %s does not match the request: %s", d.EdgeGateway, err)
+		}
+	}
+
+	return nil
+}
+
+// natMapping is a NAT rule reduced to what conflicts are detected on:
+// its name, type, external address and external ports ("" or any for
+// every port). NSX-V rules have no name, their description stands in.
+type natMapping struct {
+	id       string
+	name     string
+	ruleType string
+	external string
+	ports    string
+	oneToOne bool
+}
+
+func (m natMapping) String() string {
+	if m.id == "" {
+		return m.name
+	}
+	if m.name == "" {
+		return m.id
+	}
+	return fmt.Sprintf("%s (%s)", m.name, m.id)
+}
+
+// allPorts reports whether the port spec of a NAT rule covers every port.
+func allPorts(ports string) bool {
+	return !markPorts(map[int]bool{}, ports)
+}
+
+// natConflict returns an error naming the first rule of existing that is
+// in the way of one of planned: a rule with the same name, or a rule of the
+// same type on the same external address when either takes every port.
+func natConflict(planned, existing []natMapping) error {
+	for _, p := range planned {
+		for _, e := range existing {
+			if p.name != "" && e.name == p.name {
+				return fmt.Errorf("NAT rule %s already uses the name %s", e, p.name)
+			}
+			if e.external != p.external || (e.ruleType != p.ruleType && !e.oneToOne) {
+				continue
+			}
+			if allPorts(p.ports) || allPorts(e.ports) {
+				return fmt.Errorf("%s rule %s already maps %s", e.ruleType, e, p.external)
+			}
+		}
+	}
+	return nil
+}
+
+// plannedNatMappings returns the NAT rules Create is about to add.
+func (d *Driver) plannedNatMappings() []natMapping {
+	if d.isNsxv() {
+		if d.NatMode == natModePortForward {
+			return []natMapping{{name: d.MachineName, ruleType: "DNAT", external: d.PublicIP, ports: d.PortRange}}
+		}
+		return []natMapping{
+			{name: d.MachineName, ruleType: "SNAT", external: d.PublicIP},
+			{name: d.MachineName, ruleType: "DNAT", external: d.PublicIP},
+		}
+	}
+
+	if d.NatMode == natModePortForward {
+		var planned []natMapping
+		for _, f := range d.forwards() {
+			planned = append(planned, natMapping{name: d.MachineName + "_" + f.name, ruleType: types.NsxtNatRuleTypeDnat, external: d.PublicIP, ports: d.PortRange})
+		}
+		return planned
+	}
+
+	var planned []natMapping
+	for _, spec := range d.oneToOneNatSpecs() {
+		planned = append(planned, natMapping{name: spec.name, ruleType: spec.ruleType, external: spec.external})
+	}
+	return planned
+}
+
+// nsxvNatMappings lists the NAT rules of an NSX-V edge gateway.
+func nsxvNatMappings(edge *govcd.EdgeGateway) []natMapping {
+	services := edge.EdgeGateway.Configuration.EdgeGatewayServiceConfiguration
+	if services == nil || services.NatService == nil {
+		return nil
+	}
+
+	var mappings []natMapping
+	for _, rule := range services.NatService.NatRule {
+		m := natMapping{id: rule.ID, name: rule.Description, ruleType: rule.RuleType}
+		switch {
+		case rule.OneToOneBasicRule != nil:
+			m.external, m.oneToOne = rule.OneToOneBasicRule.ExternalIPAddress, true
+		case rule.GatewayNatRule == nil:
+			continue
+		case rule.RuleType == "SNAT":
+			m.external = rule.GatewayNatRule.TranslatedIP
+		default:
+			m.external, m.ports = rule.GatewayNatRule.OriginalIP, rule.GatewayNatRule.OriginalPort
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings
+}
+
+// nsxtNatMappings lists the NAT rules of an NSX-T edge gateway.
+func nsxtNatMappings(edge *govcd.NsxtEdgeGateway) ([]natMapping, error) {
+	rules, err := edge.GetAllNatRules(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var mappings []natMapping
+	for _, rule := range rules {
+		r := rule.NsxtNatRule
+		mappings = append(mappings, natMapping{id: r.ID, name: r.Name, ruleType: r.RuleType, external: r.ExternalAddresses, ports: r.DnatExternalPort})
+	}
+	return mappings, nil
+}
+
+// checkNatConflicts refuses to go on when the NAT rules already on the edge
+// gateway are in the way of the ones Create would add.
+func (d *Driver) checkNatConflicts(c *vcdConnection) error {
+	var existing []natMapping
+	if d.isNsxv() {
+		edge, err := d.nsxvEdge(c)
+		if err != nil {
+			return err
+		}
+		existing = nsxvNatMappings(edge)
+	} else {
+		edge, err := d.nsxtEdge(c)
+		if err != nil {
+			return err
+		}
+		if existing, err = nsxtNatMappings(edge); err != nil {
+			return err
+		}
+	}
+
+	if err := natConflict(d.plannedNatMappings(), existing); err != nil {
+		return fmt.Errorf("Unable to publish %s on %s: %s", d.MachineName, d.EdgeGateway, err)
+	}
+	return nil
+}
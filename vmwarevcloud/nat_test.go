@@ -0,0 +1,119 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"testing"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestOneToOneNatSpecs(t *testing.T) {
+	d := &Driver{PublicIP: "203.0.113.5", PrivateIP: "192.168.10.20", BaseDriver: &drivers.BaseDriver{MachineName: "m"}}
+	specs := d.oneToOneNatSpecs()
+
+	assert.Len(t, specs, 2)
+	for _, spec := range specs {
+		assert.Equal(t, "203.0.113.5", spec.external, spec.name)
+		assert.Equal(t, "192.168.10.20", spec.internal, spec.name)
+	}
+	assert.Equal(t, types.NsxtNatRuleTypeSnat, specs[0].ruleType)
+	assert.Equal(t, types.NsxtNatRuleTypeDnat, specs[1].ruleType)
+}
+
+func TestNsxtNatRuleSpecValidate(t *testing.T) {
+	network := &types.OrgVDCNetwork{
+		Name: "net",
+		Configuration: &types.NetworkConfiguration{
+			IPScopes: &types.IPScopes{IPScope: []*types.IPScope{
+				{Gateway: "192.168.10.1", Netmask: "255.255.255.0"},
+			}},
+		},
+	}
+	allocated := map[string]bool{"203.0.113.5": true}
+
+	spec := nsxtNatRuleSpec{name: "m_dnat", ruleType: types.NsxtNatRuleTypeDnat, external: "203.0.113.5", internal: "192.168.10.20"}
+	assert.NoError(t, spec.validate(network, allocated))
+
+	bad := spec
+	bad.internal = "10.0.0.20"
+	assert.Error(t, bad.validate(network, allocated))
+
+	bad = spec
+	bad.external = "203.0.113.6"
+	assert.Error(t, bad.validate(network, allocated))
+
+	bad = spec
+	bad.ruleType = types.NsxtNatRuleTypeSnat
+	bad.externalPort = "20000"
+	assert.Error(t, bad.validate(network, allocated))
+}
+
+func TestNsxtNatRuleSpecCheck(t *testing.T) {
+	spec := nsxtNatRuleSpec{
+		name:          "m_ssh",
+		ruleType:      types.NsxtNatRuleTypeDnat,
+		external:      "203.0.113.5",
+		internal:      "192.168.10.20",
+		externalPort:  "20000",
+		portProfileID: "profile",
+		firewallMatch: types.NsxtNatRuleFirewallMatchInternalAddress,
+	}
+
+	rule := spec.definition("m")
+	assert.NoError(t, spec.check(rule))
+
+	rule.ExternalAddresses, rule.InternalAddresses = rule.InternalAddresses, rule.ExternalAddresses
+	assert.Error(t, spec.check(rule))
+
+	rule = spec.definition("m")
+	rule.Enabled = false
+	assert.Error(t, spec.check(rule))
+}
+
+func TestNatConflict(t *testing.T) {
+	existing := []natMapping{
+		{id: "1", name: "other_dnat", ruleType: types.NsxtNatRuleTypeDnat, external: "203.0.113.5"},
+		{id: "2", name: "other_ssh", ruleType: types.NsxtNatRuleTypeDnat, external: "203.0.113.6", ports: "20000"},
+		{id: "3", name: "network", ruleType: types.NsxtNatRuleTypeSnat, external: "203.0.113.6"},
+	}
+
+	// Same external address.
+	err := natConflict([]natMapping{{name: "m_dnat", ruleType: types.NsxtNatRuleTypeDnat, external: "203.0.113.5"}}, existing)
+	assert.EqualError(t, err, "DNAT rule other_dnat (1) already maps 203.0.113.5")
+
+	// Same name.
+	err = natConflict([]natMapping{{name: "other_ssh", ruleType: types.NsxtNatRuleTypeDnat, external: "203.0.113.7"}}, existing)
+	assert.EqualError(t, err, "NAT rule other_ssh (2) already uses the name other_ssh")
+
+	// Forwarded ports share an address with other forwards and SNAT rules.
+	planned := []natMapping{{name: "m_ssh", ruleType: types.NsxtNatRuleTypeDnat, external: "203.0.113.6", ports: "20000-29999"}}
+	assert.NoError(t, natConflict(planned, existing))
+
+	// A 1:1 mapping does not.
+	planned = []natMapping{{name: "m_dnat", ruleType: types.NsxtNatRuleTypeDnat, external: "203.0.113.6"}}
+	assert.Error(t, natConflict(planned, existing))
+
+	// NSX-V 1:1 rules conflict with both types.
+	existing = []natMapping{{id: "65537", ruleType: "NAT", external: "203.0.113.8", oneToOne: true}}
+	planned = []natMapping{{name: "m", ruleType: "SNAT", external: "203.0.113.8"}}
+	assert.EqualError(t, natConflict(planned, existing), "NAT rule 65537 already maps 203.0.113.8")
+}
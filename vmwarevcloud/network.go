@@ -0,0 +1,327 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+// netplanOverride is written by the customization script so that it is
+// read after the file vCloud Director guest customization generates.
+const netplanOverride = "/etc/netplan/99-zz-docker-machine.yaml"
+
+// Ways of applying the network adapters to the template VM.
+const (
+	nicUpdateReplace = "replace"
+	nicUpdateInPlace = "in-place"
+)
+
+// nicSpec describes one network adapter of the machine.
+type nicSpec struct {
+	Network     string
+	AdapterType string
+	Mode        string
+	IP          string
+}
+
+// parseNICSpec parses a -vcd-network value, name[:adapter][:mode][:ip].
+// The mode defaults to MANUAL when an IP is given and to DHCP otherwise.
+func parseNICSpec(value string) (nicSpec, error) {
+	parts := strings.Split(value, ":")
+	if parts[0] == "" || len(parts) > 4 {
+		return nicSpec{}, fmt.Errorf("Invalid -vcd-network %q, expected name[:adapter][:mode][:ip]", value)
+	}
+	parts = append(parts, "", "", "")
+
+	spec := nicSpec{
+		Network:     parts[0],
+		AdapterType: parts[1],
+		Mode:        strings.ToUpper(parts[2]),
+		IP:          parts[3],
+	}
+
+	if spec.Mode == "" {
+		spec.Mode = types.IPAllocationModeDHCP
+		if spec.IP != "" {
+			spec.Mode = types.IPAllocationModeManual
+		}
+	}
+
+	switch spec.Mode {
+	case types.IPAllocationModeDHCP, types.IPAllocationModePool, types.IPAllocationModeNone:
+		if spec.IP != "" {
+			return nicSpec{}, fmt.Errorf("Invalid -vcd-network %q, an IP address needs the MANUAL mode", value)
+		}
+	case types.IPAllocationModeManual:
+		if net.ParseIP(spec.IP) == nil {
+			return nicSpec{}, fmt.Errorf("Invalid -vcd-network %q, the MANUAL mode needs a valid IP address", value)
+		}
+	default:
+		return nicSpec{}, fmt.Errorf("Invalid -vcd-network %q, mode must be DHCP, POOL, MANUAL or NONE", value)
+	}
+
+	return spec, nil
+}
+
+// nicSpecs returns the network adapters of the machine, either from the
+// -vcd-network flags or from the single network flags.
+func (d *Driver) nicSpecs() ([]nicSpec, error) {
+	if len(d.Networks) == 0 {
+		return []nicSpec{{
+			Network:     d.OrgVDCNet,
+			AdapterType: d.AdapterType,
+			Mode:        d.IPAddressAllocationMode,
+			IP:          d.StaticIP,
+		}}, nil
+	}
+
+	specs := make([]nicSpec, 0, len(d.Networks))
+	for _, value := range d.Networks {
+		spec, err := parseNICSpec(value)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// replaceNICs replaces the network adapters of vm with one adapter per
+// spec. Adapters are removed first, as vCloud Director releases before 10
+// do not change the adapter type of an existing NIC. This drops the MAC
+// addresses and any extra adapter of the template, see updateNICsInPlace.
+func (d *Driver) replaceNICs(vm *govcd.VM, specs []nicSpec) error {
+	netCfg, err := vm.GetNetworkConnectionSection()
+	if err != nil {
+		return fmt.Errorf("Error read network section for update: %s", err)
+	}
+
+	netCfg.NetworkConnection = netCfg.NetworkConnection[:0]
+	err = vm.UpdateNetworkConnectionSection(netCfg)
+	if err != nil {
+		return fmt.Errorf("Error truncate network: %s", err)
+	}
+
+	for i, spec := range specs {
+		netCfg.NetworkConnection = append(netCfg.NetworkConnection, &types.NetworkConnection{
+			Network:                 spec.Network,
+			NetworkAdapterType:      spec.AdapterType,
+			IPAddressAllocationMode: spec.Mode,
+			IPAddress:               spec.IP,
+			NetworkConnectionIndex:  i,
+			IsConnected:             true,
+			// POOL and MANUAL addresses only reach the guest through
+			// guest customization.
+			NeedsCustomization: spec.Mode != types.IPAllocationModeDHCP,
+		})
+	}
+	netCfg.PrimaryNetworkConnectionIndex = d.PrimaryNIC
+
+	err = vm.UpdateNetworkConnectionSection(netCfg)
+	if err != nil {
+		return fmt.Errorf("Error update network: %s", err)
+	}
+	return nil
+}
+
+// updateNICsInPlace reconfigures the network adapters of vm from specs
+// without removing them, see applyNICSpecs.
+func (d *Driver) updateNICsInPlace(vm *govcd.VM, specs []nicSpec) error {
+	netCfg, err := vm.GetNetworkConnectionSection()
+	if err != nil {
+		return fmt.Errorf("Error read network section for update: %s", err)
+	}
+
+	applyNICSpecs(netCfg, specs, d.PrimaryNIC)
+
+	err = vm.UpdateNetworkConnectionSection(netCfg)
+	if err != nil {
+		return fmt.Errorf("Error update network: %s", err)
+	}
+	return nil
+}
+
+// applyNICSpecs applies each spec to the adapter of section with the same
+// connection index, keeping its MAC address, and adds the adapters the
+// template lacks. Template adapters beyond the specs are left untouched.
+func applyNICSpecs(section *types.NetworkConnectionSection, specs []nicSpec, primary int) {
+	for i, spec := range specs {
+		var nic *types.NetworkConnection
+		for _, connection := range section.NetworkConnection {
+			if connection.NetworkConnectionIndex == i {
+				nic = connection
+				break
+			}
+		}
+		if nic == nil {
+			nic = &types.NetworkConnection{NetworkConnectionIndex: i}
+			section.NetworkConnection = append(section.NetworkConnection, nic)
+		}
+
+		nic.Network = spec.Network
+		if spec.AdapterType != "" {
+			nic.NetworkAdapterType = spec.AdapterType
+		}
+		nic.IPAddressAllocationMode = spec.Mode
+		nic.IPAddress = spec.IP
+		nic.IsConnected = true
+		nic.NeedsCustomization = spec.Mode != types.IPAllocationModeDHCP
+	}
+	section.PrimaryNetworkConnectionIndex = primary
+}
+
+// nicAddress returns the IP address of the adapter with the given
+// connection index, or "" while it has none.
+func nicAddress(section *types.NetworkConnectionSection, index int) string {
+	if section == nil {
+		return ""
+	}
+	for _, connection := range section.NetworkConnection {
+		if connection.NetworkConnectionIndex == index {
+			return connection.IPAddress
+		}
+	}
+	return ""
+}
+
+// ipScopeNet returns the subnet of scope.
+func ipScopeNet(scope *types.IPScope) (*net.IPNet, error) {
+	gateway := net.ParseIP(scope.Gateway)
+	mask := net.ParseIP(scope.Netmask)
+	if gateway == nil || mask == nil || gateway.To4() == nil || mask.To4() == nil {
+		return nil, fmt.Errorf("invalid IP scope %s/%s", scope.Gateway, scope.Netmask)
+	}
+
+	ipMask := net.IPMask(mask.To4())
+	return &net.IPNet{IP: gateway.To4().Mask(ipMask), Mask: ipMask}, nil
+}
+
+// checkStaticIP verifies that ip can be given manually on network: it must
+// lie inside one of the network's IP scopes and not be its gateway.
+func checkStaticIP(network *types.OrgVDCNetwork, ip string) error {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("Invalid IP address %q", ip)
+	}
+
+	if network.Configuration == nil || network.Configuration.IPScopes == nil {
+		return fmt.Errorf("Org VDC network %s has no IP scope to check %s against", network.Name, ip)
+	}
+
+	var scopes []string
+	for _, scope := range network.Configuration.IPScopes.IPScope {
+		subnet, err := ipScopeNet(scope)
+		if err != nil {
+			continue
+		}
+		if subnet.Contains(addr) {
+			if addr.Equal(net.ParseIP(scope.Gateway)) {
+				return fmt.Errorf("IP address %s is the gateway of Org VDC network %s", ip, network.Name)
+			}
+			return nil
+		}
+		scopes = append(scopes, subnet.String())
+	}
+
+	return fmt.Errorf("IP address %s is outside the IP scope of Org VDC network %s (%s)", ip, network.Name, strings.Join(scopes, ", "))
+}
+
+// checkAddressing validates the IP allocation flags. A static IP address
+// selects MANUAL mode unless another mode was asked for explicitly.
+func (d *Driver) checkAddressing() error {
+	if d.IPAddressAllocationMode == "" {
+		d.IPAddressAllocationMode = defaultIPAddressAllocationMode
+	}
+
+	switch d.IPAddressAllocationMode {
+	case types.IPAllocationModeDHCP, types.IPAllocationModePool, types.IPAllocationModeManual, types.IPAllocationModeNone:
+	default:
+		return fmt.Errorf("Invalid -vcd-ipaddressallocationmode %q, expected DHCP, POOL, MANUAL or NONE", d.IPAddressAllocationMode)
+	}
+
+	if d.StaticIP != "" {
+		if d.IPAddressAllocationMode == defaultIPAddressAllocationMode {
+			d.IPAddressAllocationMode = types.IPAllocationModeManual
+		}
+		if d.IPAddressAllocationMode != types.IPAllocationModeManual {
+			return fmt.Errorf("-vcd-ip-address needs the MANUAL allocation mode, not %s", d.IPAddressAllocationMode)
+		}
+	} else if d.IPAddressAllocationMode == types.IPAllocationModeManual {
+		return fmt.Errorf("Please specify -vcd-ip-address for the MANUAL allocation mode")
+	} else if d.Netmask != "" {
+		// DHCP and pool addresses come with the netmask of the network.
+		return fmt.Errorf("-vcd-netmask needs -vcd-ip-address")
+	}
+
+	for name, value := range map[string]string{"-vcd-ip-address": d.StaticIP, "-vcd-gateway": d.Gateway, "-vcd-netmask": d.Netmask} {
+		if value != "" && net.ParseIP(value) == nil {
+			return fmt.Errorf("Invalid %s %q", name, value)
+		}
+	}
+	for _, dns := range d.DNS {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("Invalid -vcd-dns %q", dns)
+		}
+	}
+
+	return nil
+}
+
+// networkCustomization returns the part of the customization script that
+// applies the gateway, DNS servers and netmask given on the command line
+// on top of what guest customization configured from the network.
+func (d *Driver) networkCustomization() string {
+	if d.Gateway == "" && d.Netmask == "" && len(d.DNS) == 0 {
+		return ""
+	}
+
+	script := "\nIFACE=$(ip -o -4 route show to default | awk '{print $5}' | head -n 1)\n"
+	script += "[ -n \"$IFACE\" ] || IFACE=$(ip -o link show | awk -F': ' '$2 != \"lo\" {print $2; exit}')\n"
+	script += "if command -v netplan >/dev/null 2>&1; then\n"
+	script += "cat > " + netplanOverride + " <<EOF\nnetwork:\n  version: 2\n  ethernets:\n    $IFACE:\n"
+	if d.StaticIP != "" && d.Netmask != "" {
+		if ones, _ := net.IPMask(net.ParseIP(d.Netmask).To4()).Size(); ones > 0 {
+			script += fmt.Sprintf("      addresses: [%s/%d]\n", d.StaticIP, ones)
+		}
+	}
+	if d.Gateway != "" {
+		script += "      gateway4: " + d.Gateway + "\n"
+	}
+	if len(d.DNS) > 0 {
+		script += "      nameservers:\n        addresses: [" + strings.Join(d.DNS, ", ") + "]\n"
+	}
+	script += "EOF\nnetplan apply\nelse\n"
+	if d.StaticIP != "" && d.Netmask != "" {
+		script += "ip addr replace " + d.StaticIP + "/" + d.Netmask + " dev $IFACE\n"
+	}
+	if d.Gateway != "" {
+		script += "ip route replace default via " + d.Gateway + " dev $IFACE\n"
+	}
+	if len(d.DNS) > 0 {
+		script += "printf 'nameserver %s\\n' " + strings.Join(d.DNS, " ") + " > /etc/resolv.conf\n"
+	}
+	script += "fi\n"
+
+	return script
+}
@@ -0,0 +1,121 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestCheckStaticIP(t *testing.T) {
+	network := &types.OrgVDCNetwork{
+		Name: "net",
+		Configuration: &types.NetworkConfiguration{
+			IPScopes: &types.IPScopes{IPScope: []*types.IPScope{
+				{Gateway: "192.168.10.1", Netmask: "255.255.255.0"},
+			}},
+		},
+	}
+
+	assert.NoError(t, checkStaticIP(network, "192.168.10.20"))
+	assert.Error(t, checkStaticIP(network, "192.168.10.1"))
+	assert.Error(t, checkStaticIP(network, "192.168.11.20"))
+	assert.Error(t, checkStaticIP(network, "not-an-ip"))
+}
+
+func TestCheckAddressing(t *testing.T) {
+	d := NewDriver("default", "path").(*Driver)
+	d.StaticIP = "192.168.10.20"
+	assert.NoError(t, d.checkAddressing())
+	assert.Equal(t, types.IPAllocationModeManual, d.IPAddressAllocationMode)
+
+	d.IPAddressAllocationMode = types.IPAllocationModePool
+	assert.Error(t, d.checkAddressing())
+
+	d = NewDriver("default", "path").(*Driver)
+	d.Netmask = "255.255.255.0"
+	assert.Error(t, d.checkAddressing())
+
+	d.StaticIP = "192.168.10.20"
+	assert.NoError(t, d.checkAddressing())
+}
+
+func TestParseNICSpec(t *testing.T) {
+	spec, err := parseNICSpec("storage")
+	assert.NoError(t, err)
+	assert.Equal(t, nicSpec{Network: "storage", Mode: types.IPAllocationModeDHCP}, spec)
+
+	spec, err = parseNICSpec("storage:VMXNET3::10.0.0.5")
+	assert.NoError(t, err)
+	assert.Equal(t, nicSpec{Network: "storage", AdapterType: "VMXNET3", Mode: types.IPAllocationModeManual, IP: "10.0.0.5"}, spec)
+
+	spec, err = parseNICSpec("storage::pool")
+	assert.NoError(t, err)
+	assert.Equal(t, types.IPAllocationModePool, spec.Mode)
+
+	for _, value := range []string{"", ":VMXNET3", "storage::DHCP:10.0.0.5", "storage::MANUAL", "storage::STATIC", "a:b:c:d:e"} {
+		_, err = parseNICSpec(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestNICAddress(t *testing.T) {
+	section := &types.NetworkConnectionSection{NetworkConnection: []*types.NetworkConnection{
+		{NetworkConnectionIndex: 0, IPAddress: "192.168.10.20"},
+		{NetworkConnectionIndex: 1, IPAddress: "10.0.0.5"},
+	}}
+
+	assert.Equal(t, "10.0.0.5", nicAddress(section, 1))
+	assert.Equal(t, "", nicAddress(section, 2))
+	assert.Equal(t, "", nicAddress(nil, 0))
+}
+
+func TestApplyNICSpecs(t *testing.T) {
+	section := &types.NetworkConnectionSection{NetworkConnection: []*types.NetworkConnection{
+		{NetworkConnectionIndex: 0, Network: "template-net", MACAddress: "00:50:56:01:00:01", NetworkAdapterType: "E1000"},
+		{NetworkConnectionIndex: 1, Network: "backup-net", MACAddress: "00:50:56:01:00:02", NetworkAdapterType: "E1000"},
+	}}
+
+	applyNICSpecs(section, []nicSpec{
+		{Network: "k8s-net", AdapterType: "VMXNET3", Mode: types.IPAllocationModePool},
+	}, 0)
+
+	assert.Len(t, section.NetworkConnection, 2)
+	nic := section.NetworkConnection[0]
+	assert.Equal(t, "k8s-net", nic.Network)
+	assert.Equal(t, "VMXNET3", nic.NetworkAdapterType)
+	assert.Equal(t, "00:50:56:01:00:01", nic.MACAddress)
+	assert.True(t, nic.NeedsCustomization)
+	assert.Equal(t, "backup-net", section.NetworkConnection[1].Network)
+	assert.Equal(t, "E1000", section.NetworkConnection[1].NetworkAdapterType)
+
+	applyNICSpecs(section, []nicSpec{
+		{Network: "k8s-net", Mode: types.IPAllocationModeDHCP},
+		{Network: "backup-net", Mode: types.IPAllocationModeDHCP},
+		{Network: "storage-net", Mode: types.IPAllocationModeManual, IP: "10.0.0.5"},
+	}, 2)
+
+	assert.Len(t, section.NetworkConnection, 3)
+	assert.Equal(t, "VMXNET3", section.NetworkConnection[0].NetworkAdapterType)
+	assert.Equal(t, 2, section.NetworkConnection[2].NetworkConnectionIndex)
+	assert.Equal(t, "10.0.0.5", section.NetworkConnection[2].IPAddress)
+	assert.Equal(t, 2, section.PrimaryNetworkConnectionIndex)
+}
@@ -0,0 +1,292 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// NAT modes of the public IP address.
+const (
+	// natMode1to1 maps the whole public IP address to the machine.
+	natMode1to1 = "1to1"
+	// natModePortForward shares the public IP address between machines,
+	// forwarding one external port each for SSH and Docker.
+	natModePortForward = "port-forward"
+)
+
+// parsePortRange parses a -vcd-port-range value, low-high.
+func parsePortRange(value string) (int, int, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid -vcd-port-range %q, expected low-high", value)
+	}
+
+	low, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid -vcd-port-range %q, expected low-high", value)
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid -vcd-port-range %q, expected low-high", value)
+	}
+	if low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("Invalid -vcd-port-range %q, ports must be 1-65535 and low <= high", value)
+	}
+
+	return low, high, nil
+}
+
+// markPorts adds the ports of a NAT rule port spec, a port or a low-high
+// range, to used. It reports false when spec covers every port.
+func markPorts(used map[int]bool, spec string) bool {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || strings.EqualFold(spec, "any") {
+		return false
+	}
+
+	low, high := spec, spec
+	if i := strings.Index(spec, "-"); i >= 0 {
+		low, high = spec[:i], spec[i+1:]
+	}
+	from, err := strconv.Atoi(low)
+	if err != nil {
+		return true
+	}
+	to, err := strconv.Atoi(high)
+	if err != nil {
+		return true
+	}
+	for port := from; port <= to; port++ {
+		used[port] = true
+	}
+	return true
+}
+
+// pickPorts returns the n lowest ports of low-high that are not used.
+func pickPorts(used map[int]bool, low, high, n int) ([]int, error) {
+	var ports []int
+	for port := low; port <= high && len(ports) < n; port++ {
+		if !used[port] {
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) < n {
+		return nil, fmt.Errorf("No free port left in %d-%d", low, high)
+	}
+	return ports, nil
+}
+
+// externalPorts picks the external SSH and Docker ports on d.PublicIP,
+// given the ports the existing DNAT rules on it use.
+func (d *Driver) externalPorts(used map[int]bool) error {
+	low, high, err := parsePortRange(d.PortRange)
+	if err != nil {
+		return err
+	}
+	ports, err := pickPorts(used, low, high, 2)
+	if err != nil {
+		return fmt.Errorf("Unable to forward ports on %s: %s", d.PublicIP, err)
+	}
+
+	d.ExternalSSHPort, d.ExternalDockerPort = ports[0], ports[1]
+	log.Infof("Forwarding %s:%d to SSH and %s:%d to Docker", d.PublicIP, d.ExternalSSHPort, d.PublicIP, d.ExternalDockerPort)
+	return nil
+}
+
+// portForward is one external port of the public IP address forwarded to
+// a port of the machine.
+type portForward struct {
+	name     string
+	external int
+	internal int
+}
+
+// forwards returns the ports forwarded in port-forward mode.
+func (d *Driver) forwards() []portForward {
+	return []portForward{
+		{name: "ssh", external: d.ExternalSSHPort, internal: d.SSHPort},
+		{name: "docker", external: d.ExternalDockerPort, internal: d.DockerPort},
+	}
+}
+
+// forwardPortsNsxv creates the NSX-V DNAT rules forwarding the external
+// SSH and Docker ports of d.PublicIP to d.PrivateIP.
+func (d *Driver) forwardPortsNsxv(edge *govcd.EdgeGateway, rb *rollback) error {
+	used := map[int]bool{}
+	var uplink string
+	for _, gi := range edge.EdgeGateway.Configuration.GatewayInterfaces.GatewayInterface {
+		if gi.InterfaceType == "uplink" && uplink == "" {
+			uplink = gi.Network.HREF
+		}
+	}
+	if services := edge.EdgeGateway.Configuration.EdgeGatewayServiceConfiguration; services != nil && services.NatService != nil {
+		for _, rule := range services.NatService.NatRule {
+			if rule.RuleType != "DNAT" || rule.GatewayNatRule == nil || rule.GatewayNatRule.OriginalIP != d.PublicIP {
+				continue
+			}
+			if !markPorts(used, rule.GatewayNatRule.OriginalPort) {
+				return fmt.Errorf("DNAT rule %s already forwards every port of %s", rule.ID, d.PublicIP)
+			}
+		}
+	}
+
+	if err := d.externalPorts(used); err != nil {
+		return err
+	}
+
+	d.Ledger.EdgeGatewayID = edge.EdgeGateway.ID
+	for _, f := range d.forwards() {
+		var rule *types.NatRule
+		err := d.retryEdgeUpdate("DNAT rule "+f.name, func() error {
+			var err error
+			rule, err = edge.AddDNATRule(govcd.NatRule{
+				NetworkHref:  uplink,
+				ExternalIP:   d.PublicIP,
+				ExternalPort: strconv.Itoa(f.external),
+				InternalIP:   d.PrivateIP,
+				InternalPort: strconv.Itoa(f.internal),
+				Protocol:     "TCP",
+				Description:  d.MachineName,
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		id := rule.ID
+		rb.add(fmt.Sprintf("DNAT rule %s:%d", d.PublicIP, f.external), func() error {
+			return d.retryEdgeUpdate("DNAT rule "+id, func() error { return edge.RemoveNATRule(id) })
+		})
+		d.Ledger.NatRuleIDs = append(d.Ledger.NatRuleIDs, id)
+	}
+
+	return nil
+}
+
+// forwardPortsNsxt creates the NSX-T DNAT rules forwarding the external
+// SSH and Docker ports of d.PublicIP to d.PrivateIP.
+func (d *Driver) forwardPortsNsxt(org *govcd.Org, edge *govcd.NsxtEdgeGateway, network *types.OrgVDCNetwork, rb *rollback) error {
+	rules, err := edge.GetAllNatRules(nil)
+	if err != nil {
+		return err
+	}
+
+	used := map[int]bool{}
+	for _, rule := range rules {
+		r := rule.NsxtNatRule
+		if r.RuleType != types.NsxtNatRuleTypeDnat || r.ExternalAddresses != d.PublicIP {
+			continue
+		}
+		if !markPorts(used, r.DnatExternalPort) {
+			return fmt.Errorf("DNAT rule %s already forwards every port of %s", r.Name, d.PublicIP)
+		}
+	}
+
+	if err = d.externalPorts(used); err != nil {
+		return err
+	}
+
+	var specs []nsxtNatRuleSpec
+	for _, f := range d.forwards() {
+		profile, err := d.tcpPortProfile(org, edge, f.internal, rb)
+		if err != nil {
+			return err
+		}
+
+		specs = append(specs, nsxtNatRuleSpec{
+			name:          d.MachineName + "_" + f.name,
+			ruleType:      types.NsxtNatRuleTypeDnat,
+			external:      d.PublicIP,
+			internal:      d.PrivateIP,
+			externalPort:  strconv.Itoa(f.external),
+			portProfileID: profile.NsxtAppPortProfile.ID,
+			firewallMatch: types.NsxtNatRuleFirewallMatchInternalAddress,
+		})
+	}
+
+	return d.createNsxtNatRules(edge, network, specs, rb)
+}
+
+// tcpPortProfile returns the tenant application port profile of the
+// machine for TCP port, which NSX-T DNAT and firewall rules use. Profiles
+// are named after the machine and recorded in the ledger, so that Remove
+// deletes them with the rules.
+func (d *Driver) tcpPortProfile(org *govcd.Org, edge *govcd.NsxtEdgeGateway, port int, rb *rollback) (*govcd.NsxtAppPortProfile, error) {
+	name := fmt.Sprintf("%s-tcp-%d", d.MachineName, port)
+	profile, err := org.GetNsxtAppPortProfileByName(name, types.ApplicationPortProfileScopeTenant)
+	if err == nil {
+		d.Ledger.AppPortProfileIDs = appendID(d.Ledger.AppPortProfileIDs, profile.NsxtAppPortProfile.ID)
+		return profile, nil
+	}
+	if !govcd.ContainsNotFound(err) {
+		return nil, err
+	}
+
+	log.Infof("Creating application port profile %s...", name)
+	profile, err = org.CreateNsxtAppPortProfile(&types.NsxtAppPortProfile{
+		Name:        name,
+		Description: d.MachineName,
+		ApplicationPorts: []types.NsxtAppPortProfilePort{{
+			Protocol:         "TCP",
+			DestinationPorts: []string{strconv.Itoa(port)},
+		}},
+		OrgRef:          &types.OpenApiReference{ID: org.Org.ID, Name: org.Org.Name},
+		ContextEntityId: edge.EdgeGateway.OrgVdc.ID,
+		Scope:           types.ApplicationPortProfileScopeTenant,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rb.add("application port profile "+name, profile.Delete)
+	d.Ledger.AppPortProfileIDs = append(d.Ledger.AppPortProfileIDs, profile.NsxtAppPortProfile.ID)
+	return profile, nil
+}
+
+// removeNsxtAppPortProfiles deletes the application port profiles recorded
+// in the ledger, once the rules using them are gone. Profiles that are
+// already gone are skipped.
+func (d *Driver) removeNsxtAppPortProfiles(org *govcd.Org) error {
+	for _, id := range d.Ledger.AppPortProfileIDs {
+		profile, err := org.GetNsxtAppPortProfileById(id)
+		if govcd.ContainsNotFound(err) {
+			log.Debugf("Application port profile %s is already gone", id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Removing application port profile %s...", profile.NsxtAppPortProfile.Name)
+		if err = profile.Delete(); err != nil {
+			return err
+		}
+	}
+
+	d.Ledger.AppPortProfileIDs = nil
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortRange(t *testing.T) {
+	low, high, err := parsePortRange("20000-29999")
+	assert.NoError(t, err)
+	assert.Equal(t, 20000, low)
+	assert.Equal(t, 29999, high)
+
+	for _, value := range []string{"", "20000", "a-b", "0-10", "30000-20000", "60000-70000"} {
+		_, _, err = parsePortRange(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestPickPorts(t *testing.T) {
+	used := map[int]bool{}
+	assert.True(t, markPorts(used, "20000"))
+	assert.True(t, markPorts(used, "20002-20003"))
+	assert.False(t, markPorts(used, "any"))
+	assert.False(t, markPorts(used, ""))
+
+	ports, err := pickPorts(used, 20000, 20010, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{20001, 20004}, ports)
+
+	_, err = pickPorts(used, 20000, 20003, 2)
+	assert.Error(t, err)
+}
+
+func TestRemoveNsxtAppPortProfiles(t *testing.T) {
+	profiles := map[string]bool{"urn:vcloud:applicationPortProfile:1": true}
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/versions" {
+			w.Header().Set("Content-Type", "application/xml")
+			_, _ = w.Write([]byte(`<SupportedVersions xmlns="http://www.vmware.com/vcloud/versions"><VersionInfo><Version>34.0</Version></VersionInfo></SupportedVersions>`))
+			return
+		}
+
+		id := path.Base(r.URL.Path)
+		if !profiles[id] {
+			// OpenAPI answers Forbidden for entities that do not exist.
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"minorErrorCode":"ACCESS_TO_RESOURCE_IS_FORBIDDEN","message":"forbidden"}`))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"id":"` + id + `","name":"default-tcp-22"}`))
+		case http.MethodDelete:
+			deleted = append(deleted, id)
+			delete(profiles, id)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	endpoint, err := url.Parse(server.URL + "/api")
+	assert.NoError(t, err)
+	client := govcd.NewVCDClient(*endpoint, true)
+	org := govcd.NewOrg(&client.Client)
+
+	driver := NewDriver("default", "path").(*Driver)
+	driver.Ledger.AppPortProfileIDs = []string{"urn:vcloud:applicationPortProfile:1", "urn:vcloud:applicationPortProfile:2"}
+
+	assert.NoError(t, driver.removeNsxtAppPortProfiles(org))
+	assert.Equal(t, []string{"urn:vcloud:applicationPortProfile:1"}, deleted)
+	assert.Empty(t, driver.Ledger.AppPortProfileIDs)
+}
@@ -0,0 +1,162 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Ways a machine was stopped, reported by Stop.
+const (
+	stopGuestShutdown = "guest shutdown"
+	stopPowerOff      = "power off"
+)
+
+// Restart modes.
+const (
+	restartModeReboot = "reboot"
+	restartModeReset  = "reset"
+)
+
+// bootIDCommand prints an ID the Linux kernel generates on every boot.
+const bootIDCommand = "cat /proc/sys/kernel/random/boot_id"
+
+// guestToolsRunningStatuses are the VMware Tools statuses of a VM query
+// record telling that the tools run in the guest.
+var guestToolsRunningStatuses = map[string]bool{
+	"toolsOk":  true,
+	"toolsOld": true,
+}
+
+// guestToolsRunning reports whether VMware Tools are running in the single
+// VM of vapp, which guest shutdown and reboot depend on. Tools that are
+// installed but stopped do not count.
+func guestToolsRunning(vdc *govcd.Vdc, vapp *govcd.VApp) bool {
+	if vapp.VApp.Children == nil || len(vapp.VApp.Children.VM) != 1 {
+		return false
+	}
+
+	record, err := vdc.QueryVM(vapp.VApp.Name, vapp.VApp.Children.VM[0].Name)
+	if err != nil {
+		log.Debugf("Unable to query the VMware Tools status of %s: %s", vapp.VApp.Name, err)
+		return false
+	}
+	return guestToolsRunningStatuses[record.VM.VmToolsStatus]
+}
+
+// stopVApp shuts the guest of vapp down through VMware Tools, falling back
+// to a power off when the tools are not running or the guest does not halt
+// within the shutdown timeout. It returns the path that was taken.
+func (d *Driver) stopVApp(ctx context.Context, vdc *govcd.Vdc, vapp *govcd.VApp) (string, error) {
+	if guestToolsRunning(vdc, vapp) {
+		log.Infof("Shutting down the guest of %s...", d.MachineName)
+		task, err := vapp.Shutdown()
+		if err == nil {
+			err = waitTask(ctx, "the guest to shut down", time.Duration(d.ShutdownTimeout)*time.Second, task)
+		}
+		if err == nil {
+			return stopGuestShutdown, nil
+		}
+		log.Warnf("Guest shutdown of %s failed, powering it off: %s", d.MachineName, err)
+	} else {
+		log.Infof("VMware Tools are not running in %s, powering it off...", d.MachineName)
+	}
+
+	if err := d.runTask("power off of "+d.MachineName, vapp.PowerOff); err != nil {
+		return "", err
+	}
+
+	return stopPowerOff, nil
+}
+
+// rebootVApp reboots the guest of vapp through VMware Tools and waits until
+// it booted again and answers SSH. The boot ID read before the reboot tells
+// a guest that came back apart from one that never went down.
+func (d *Driver) rebootVApp(ctx context.Context, vapp *govcd.VApp) error {
+	timeout := time.Duration(d.RebootTimeout) * time.Second
+
+	bootID, err := drivers.RunSSHCommandFromDriver(d, bootIDCommand)
+	if err != nil {
+		log.Debugf("Unable to read the boot ID of %s before rebooting: %s", d.MachineName, err)
+		bootID = ""
+	}
+	bootID = strings.TrimSpace(bootID)
+
+	log.Infof("Rebooting the guest of %s...", d.MachineName)
+	task, err := vapp.Reboot()
+	if err != nil {
+		return err
+	}
+	if err = waitTask(ctx, "the guest reboot", timeout, task); err != nil {
+		return err
+	}
+
+	return waitFor(ctx, "the guest to come back and answer SSH", timeout, func() (bool, error) {
+		out, err := drivers.RunSSHCommandFromDriver(d, bootIDCommand)
+		if err != nil {
+			return false, nil
+		}
+		return bootID == "" || strings.TrimSpace(out) != bootID, nil
+	})
+}
+
+// Suspend suspends the machine with its memory state, so dev hosts can be
+// parked and later resumed by Start where they left off.
+func (d *Driver) Suspend() error {
+	c, err := d.connect()
+	if err != nil {
+		return err
+	}
+
+	vapp, err := c.vdc.FindVAppByID(d.VAppID)
+	if err != nil {
+		return err
+	}
+
+	status, err := vapp.GetStatus()
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case "SUSPENDED":
+		log.Infof("%s is already suspended", d.MachineName)
+		return nil
+	case "POWERED_ON":
+	default:
+		return fmt.Errorf("Unable to suspend %s, it is %s", d.MachineName, status)
+	}
+
+	log.Infof("Suspending %s...", d.MachineName)
+	if err := d.runTask("suspend of "+d.MachineName, vapp.Suspend); err != nil {
+		return err
+	}
+
+	d.IPAddress = ""
+
+	return nil
+}
@@ -0,0 +1,64 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGuestToolsRunning(t *testing.T) {
+	toolsStatus := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.vmware.vcloud.query.records+xml")
+		fmt.Fprintf(w, `<QueryResultRecords xmlns="http://www.vmware.com/vcloud/v1.5"><VMRecord name="default" containerName="default" vmToolsStatus="%s"/></QueryResultRecords>`, toolsStatus)
+	}))
+	defer server.Close()
+
+	endpoint, err := url.Parse(server.URL + "/api")
+	assert.NoError(t, err)
+	client := govcd.NewVCDClient(*endpoint, true)
+	vdc := govcd.NewVdc(&client.Client)
+
+	vapp := &govcd.VApp{VApp: &types.VApp{Name: "default"}}
+	assert.False(t, guestToolsRunning(vdc, vapp))
+
+	vapp.VApp.Children = &types.VAppChildren{VM: []*types.Vm{{Name: "default"}}}
+	for status, running := range map[string]bool{
+		"toolsOk":           true,
+		"toolsOld":          true,
+		"toolsNotRunning":   false,
+		"toolsNotInstalled": false,
+	} {
+		toolsStatus = status
+		assert.Equal(t, running, guestToolsRunning(vdc, vapp), status)
+	}
+
+	toolsStatus = "toolsOk"
+	vapp.VApp.Children.VM = append(vapp.VApp.Children.VM, &types.Vm{Name: "other"})
+	assert.False(t, guestToolsRunning(vdc, vapp))
+}
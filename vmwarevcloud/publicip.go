@@ -0,0 +1,229 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// publicIPAuto as -vcd-publicip picks a free address sub-allocated to the
+// edge gateway.
+const publicIPAuto = "auto"
+
+// Addresses of -vcd-endpoint-address.
+const (
+	endpointPrivate = "private"
+	endpointPublic  = "public"
+	endpointAuto    = "auto"
+)
+
+// usePublicIP reports whether docker-machine reaches the machine on its
+// public IP rather than on the address of its primary NIC. In auto mode it
+// does whenever the machine has a public IP. Machines created before
+// -vcd-endpoint-address existed have none stored and keep their private
+// address until EndpointAddress is set in their config.
+func (d *Driver) usePublicIP() bool {
+	switch d.EndpointAddress {
+	case endpointPublic:
+		return true
+	case endpointAuto:
+		return d.PublicIP != "" && d.PublicIP != publicIPAuto
+	}
+	return false
+}
+
+// maxRangeSize bounds the addresses taken from one sub-allocated range.
+const maxRangeSize = 65536
+
+// expandRange returns the IPv4 addresses from start to end inclusive.
+func expandRange(start, end string) ([]string, error) {
+	from, to := net.ParseIP(start).To4(), net.ParseIP(end).To4()
+	if from == nil || to == nil {
+		return nil, fmt.Errorf("invalid IPv4 range %s-%s", start, end)
+	}
+
+	first, last := binary.BigEndian.Uint32(from), binary.BigEndian.Uint32(to)
+	if first > last || last-first >= maxRangeSize {
+		return nil, fmt.Errorf("invalid IPv4 range %s-%s", start, end)
+	}
+
+	ips := make([]string, 0, last-first+1)
+	for n := first; ; n++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, n)
+		ips = append(ips, ip.String())
+		if n == last {
+			break
+		}
+	}
+	return ips, nil
+}
+
+// pickPublicIP returns the first candidate not in used.
+func pickPublicIP(candidates []string, used map[string]bool) (string, error) {
+	for _, ip := range candidates {
+		if !used[ip] {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("No free IP address left among the %d sub-allocated to the edge gateway", len(candidates))
+}
+
+// reservePublicIP replaces -vcd-publicip auto by a free address of the edge
+// gateway. In port-forward mode addresses whose NAT rules forward single
+// ports are still free, so that machines share them.
+func (d *Driver) reservePublicIP(c *vcdConnection) error {
+	var candidates []string
+	used := map[string]bool{}
+
+	if d.isNsxv() {
+		edge, err := d.nsxvEdge(c)
+		if err != nil {
+			return err
+		}
+		if candidates, err = nsxvSubAllocatedIPs(edge, used); err != nil {
+			return err
+		}
+		d.markNsxvUsedIPs(edge, used)
+	} else {
+		edge, err := d.nsxtEdge(c)
+		if err != nil {
+			return err
+		}
+		if candidates, err = nsxtSubAllocatedIPs(edge, used); err != nil {
+			return err
+		}
+		if err = d.markNsxtUsedIPs(edge, used); err != nil {
+			return err
+		}
+	}
+
+	ip, err := pickPublicIP(candidates, used)
+	if err != nil {
+		return fmt.Errorf("Unable to pick a public IP on %s: %s", d.EdgeGateway, err)
+	}
+
+	log.Infof("Using public IP %s of %s", ip, d.EdgeGateway)
+	d.PublicIP = ip
+	return nil
+}
+
+// nsxvSubAllocatedIPs lists the addresses sub-allocated to the uplinks of
+// edge, marking the addresses of the edge itself as used.
+func nsxvSubAllocatedIPs(edge *govcd.EdgeGateway, used map[string]bool) ([]string, error) {
+	var ips []string
+	for _, gi := range edge.EdgeGateway.Configuration.GatewayInterfaces.GatewayInterface {
+		if gi.InterfaceType != "uplink" {
+			continue
+		}
+		for _, subnet := range gi.SubnetParticipation {
+			used[subnet.IPAddress] = true
+			if subnet.IPRanges == nil {
+				continue
+			}
+			for _, r := range subnet.IPRanges.IPRange {
+				rangeIPs, err := expandRange(r.StartAddress, r.EndAddress)
+				if err != nil {
+					return nil, err
+				}
+				ips = append(ips, rangeIPs...)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// markNsxvUsedIPs marks the external addresses of the NAT rules of edge.
+func (d *Driver) markNsxvUsedIPs(edge *govcd.EdgeGateway, used map[string]bool) {
+	services := edge.EdgeGateway.Configuration.EdgeGatewayServiceConfiguration
+	if services == nil || services.NatService == nil {
+		return
+	}
+
+	for _, rule := range services.NatService.NatRule {
+		if rule.OneToOneBasicRule != nil {
+			used[rule.OneToOneBasicRule.ExternalIPAddress] = true
+		}
+		if rule.GatewayNatRule == nil {
+			continue
+		}
+		switch rule.RuleType {
+		case "DNAT":
+			if d.NatMode != natModePortForward || !markPorts(map[int]bool{}, rule.GatewayNatRule.OriginalPort) {
+				used[rule.GatewayNatRule.OriginalIP] = true
+			}
+		case "SNAT":
+			if d.NatMode != natModePortForward {
+				used[rule.GatewayNatRule.TranslatedIP] = true
+			}
+		}
+	}
+}
+
+// nsxtSubAllocatedIPs lists the addresses sub-allocated to the uplinks of
+// edge, marking the primary address of each subnet as used.
+func nsxtSubAllocatedIPs(edge *govcd.NsxtEdgeGateway, used map[string]bool) ([]string, error) {
+	var ips []string
+	for _, uplink := range edge.EdgeGateway.EdgeGatewayUplinks {
+		for _, subnet := range uplink.Subnets.Values {
+			used[subnet.PrimaryIP] = true
+			if subnet.IPRanges == nil {
+				continue
+			}
+			for _, r := range subnet.IPRanges.Values {
+				rangeIPs, err := expandRange(r.StartAddress, r.EndAddress)
+				if err != nil {
+					return nil, err
+				}
+				ips = append(ips, rangeIPs...)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// markNsxtUsedIPs marks the external addresses of the NAT rules of edge.
+func (d *Driver) markNsxtUsedIPs(edge *govcd.NsxtEdgeGateway, used map[string]bool) error {
+	rules, err := edge.GetAllNatRules(nil)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		r := rule.NsxtNatRule
+		switch r.RuleType {
+		case types.NsxtNatRuleTypeDnat:
+			if d.NatMode != natModePortForward || !markPorts(map[int]bool{}, r.DnatExternalPort) {
+				used[r.ExternalAddresses] = true
+			}
+		case types.NsxtNatRuleTypeSnat:
+			if d.NatMode != natModePortForward {
+				used[r.ExternalAddresses] = true
+			}
+		}
+	}
+	return nil
+}
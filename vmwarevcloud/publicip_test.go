@@ -0,0 +1,91 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandRange(t *testing.T) {
+	ips, err := expandRange("203.0.113.254", "203.0.114.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"203.0.113.254", "203.0.113.255", "203.0.114.0", "203.0.114.1"}, ips)
+
+	ips, err = expandRange("203.0.113.5", "203.0.113.5")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"203.0.113.5"}, ips)
+
+	for _, r := range [][2]string{{"203.0.113.9", "203.0.113.5"}, {"2001:db8::1", "2001:db8::5"}, {"10.0.0.0", "10.255.255.255"}} {
+		_, err = expandRange(r[0], r[1])
+		assert.Error(t, err, r[0])
+	}
+}
+
+func TestPickPublicIP(t *testing.T) {
+	candidates := []string{"203.0.113.10", "203.0.113.11", "203.0.113.12"}
+
+	ip, err := pickPublicIP(candidates, map[string]bool{"203.0.113.10": true})
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.11", ip)
+
+	_, err = pickPublicIP(candidates, map[string]bool{"203.0.113.10": true, "203.0.113.11": true, "203.0.113.12": true})
+	assert.Error(t, err)
+}
+
+func TestGetIP(t *testing.T) {
+	d := &Driver{PrivateIP: "192.168.10.20", PrivateIPv6: "fd00::20", PublicIP: "203.0.113.5", EndpointAddress: endpointAuto}
+	ip, err := d.GetIP()
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.5", ip)
+
+	d.EndpointAddress = endpointPrivate
+	ip, _ = d.GetIP()
+	assert.Equal(t, "192.168.10.20", ip)
+
+	d.PreferIPv6 = true
+	ip, _ = d.GetIP()
+	assert.Equal(t, "fd00::20", ip)
+
+	d.EndpointAddress = endpointPublic
+	ip, _ = d.GetIP()
+	assert.Equal(t, "203.0.113.5", ip)
+
+	// Not reserved yet, auto falls back to the private address.
+	d = &Driver{PrivateIP: "192.168.10.20", PublicIP: publicIPAuto, EndpointAddress: endpointAuto}
+	ip, _ = d.GetIP()
+	assert.Equal(t, "192.168.10.20", ip)
+
+	d.EndpointAddress = endpointPublic
+	_, err = d.GetIP()
+	assert.Error(t, err)
+
+	// Machines created before the flag existed have no endpoint address.
+	d = NewDriver("default", "path").(*Driver)
+	assert.NoError(t, json.Unmarshal([]byte(`{"PrivateIP": "192.168.10.20", "PublicIP": "203.0.113.5"}`), d))
+	ip, _ = d.GetIP()
+	assert.Equal(t, "192.168.10.20", ip)
+
+	// Setting the field in the config opts them in.
+	assert.NoError(t, json.Unmarshal([]byte(`{"EndpointAddress": "auto"}`), d))
+	ip, _ = d.GetIP()
+	assert.Equal(t, "203.0.113.5", ip)
+}
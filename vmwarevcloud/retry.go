@@ -0,0 +1,250 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// retryMaxWait caps the wait between two attempts.
+const retryMaxWait = 30 * time.Second
+
+// Substrings of vCloud Director and network errors, lower cased, telling
+// that the same HTTP request may succeed when sent again.
+var transientErrors = []string{
+	"service unavailable",
+	"bad gateway",
+	"gateway timeout",
+	"maintenance",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"unexpected eof",
+	"i/o timeout",
+	"tls handshake timeout",
+}
+
+// Substrings of vCloud Director errors, lower cased, telling that an
+// operation was refused because the entity was busy with another one, or
+// its task aborted by a concurrent modification of the entity. Such an
+// operation did not take effect and can be started again.
+var busyErrors = []string{
+	"busy_entity",
+	"is busy completing an operation",
+	"concurrent modification",
+}
+
+// serverError matches vCloud Director errors with a 5xx status, "API
+// Error: 503: ..." from govcd or a bare "503 Service Unavailable".
+var serverError = regexp.MustCompile(`(?i)(api error: 5\d\d\b|^5\d\d )`)
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// jitter returns a random duration in [0, max), so that processes backing
+// off from the same failure do not retry in step.
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(max)))
+}
+
+// isTransient classifies err as retryable, as opposed to fatal.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	if serverError.MatchString(message) {
+		return true
+	}
+	for _, s := range transientErrors {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBusy reports whether err means the operation was refused or aborted
+// because the entity was busy.
+func isBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := strings.ToLower(err.Error())
+	for _, s := range busyErrors {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryPolicy is how often and how patiently a failing call is retried.
+type retryPolicy struct {
+	attempts int
+	wait     time.Duration
+}
+
+// retryPolicy returns the policy of -vcd-retry-attempts and
+// -vcd-retry-wait.
+func (d *Driver) retryPolicy() retryPolicy {
+	p := retryPolicy{attempts: d.RetryAttempts, wait: time.Duration(d.RetryWait) * time.Second}
+	if p.attempts <= 0 {
+		p.attempts = defaultRetryAttempts
+	}
+	if p.wait <= 0 {
+		p.wait = defaultRetryWait * time.Second
+	}
+	return p
+}
+
+// delay returns the jittered wait before attempt, counted from 2.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	wait := p.wait
+	for i := 2; i < attempt && wait < retryMaxWait; i++ {
+		wait *= 2
+	}
+	if wait > retryMaxWait {
+		wait = retryMaxWait
+	}
+	return wait + jitter(wait)
+}
+
+// do runs call until it succeeds, fails with an error retryable does not
+// accept, or the attempts are used up, logging each retry of what.
+func (p retryPolicy) do(what string, retryable func(error) bool, call func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || !retryable(err) || attempt >= p.attempts {
+			return err
+		}
+
+		delay := p.delay(attempt + 1)
+		log.Infof("Retrying %s in %s (attempt %d of %d): %s", what, delay.Round(time.Second), attempt+1, p.attempts, err)
+		time.Sleep(delay)
+	}
+}
+
+// runTask starts a vCloud Director task and waits for it, starting it
+// again when the entity was busy or the task was aborted by a concurrent
+// modification. Transient HTTP errors are already retried by
+// retryTransport, and a task whose outcome is unknown is not started twice.
+func (d *Driver) runTask(what string, start func() (govcd.Task, error)) error {
+	return d.retryPolicy().do(what, isBusy, func() error {
+		task, err := start()
+		if err != nil {
+			return err
+		}
+		return task.WaitTaskCompletion()
+	})
+}
+
+// runTaskWithin is runTask for a task bounded by timeout and ctx, which is
+// cancelled when either runs out.
+func (d *Driver) runTaskWithin(ctx context.Context, what string, timeout time.Duration, start func() (govcd.Task, error)) error {
+	return d.retryPolicy().do(what, isBusy, func() error {
+		task, err := start()
+		if err != nil {
+			return err
+		}
+		return waitTask(ctx, what, timeout, task)
+	})
+}
+
+// retryTransport retries the HTTP requests of govcd that failed on the
+// network or with a 502, 503 or 504 status, so that every API call of the
+// driver rides out a load balancer or cell restart. Requests that may have
+// reached vCloud Director are only retried when they are idempotent.
+type retryTransport struct {
+	next   http.RoundTripper
+	policy retryPolicy
+}
+
+// retryTransport wraps next, the transport of a govcd client.
+func (d *Driver) retryTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &retryTransport{next: next, policy: d.retryPolicy()}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	idempotent := req.Method != http.MethodPost && req.Method != http.MethodPatch
+	for attempt := 1; ; attempt++ {
+		r := req
+		if attempt > 1 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(r)
+
+		var reason string
+		switch {
+		case err != nil && (errors.Is(err, syscall.ECONNREFUSED) || (idempotent && isTransient(err))):
+			reason = err.Error()
+		case err == nil && (resp.StatusCode == http.StatusServiceUnavailable ||
+			(idempotent && (resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout))):
+			reason = resp.Status
+		}
+		if reason == "" || attempt >= t.policy.attempts || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		delay := t.policy.delay(attempt + 1)
+		log.Infof("Retrying %s %s in %s (attempt %d of %d): %s", req.Method, req.URL.Path, delay.Round(time.Second), attempt+1, t.policy.attempts, reason)
+		select {
+		case <-req.Context().Done():
+			return nil, fmt.Errorf("Cancelled retrying %s %s: %s", req.Method, req.URL.Path, req.Context().Err())
+		case <-time.After(delay):
+		}
+	}
+}
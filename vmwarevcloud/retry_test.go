@@ -0,0 +1,154 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransient(t *testing.T) {
+	for _, message := range []string{
+		"API Error: 503: Service is in maintenance",
+		"502 Bad Gateway",
+		"read tcp 10.0.0.1:443: connection reset by peer",
+	} {
+		assert.True(t, isTransient(errors.New(message)), message)
+	}
+
+	for _, message := range []string{
+		"API Error: 400: Invalid IP address",
+		"API Error: 403: Access denied",
+		"error retrieving port 5000 settings",
+		"The entity vApp (urn:vcloud:vapp:1) is busy completing an operation.",
+	} {
+		assert.False(t, isTransient(errors.New(message)), message)
+	}
+}
+
+func TestIsBusy(t *testing.T) {
+	for _, message := range []string{
+		"The entity vApp (urn:vcloud:vapp:1) is busy completing an operation.",
+		"API Error: 400: [ BUSY_ENTITY ] The entity is busy",
+		"task aborted: the operation was aborted due to a concurrent modification",
+	} {
+		assert.True(t, isBusy(errors.New(message)), message)
+	}
+
+	for _, message := range []string{
+		"API Error: 503: Service is in maintenance",
+		"read tcp 10.0.0.1:443: connection reset by peer",
+		"API Error: 400: Invalid IP address",
+		// Unrelated errors mentioning an abort or a busy resource.
+		"task aborted by user",
+		"the guest customization was aborted",
+		"disk full: device or resource busy",
+	} {
+		assert.False(t, isBusy(errors.New(message)), message)
+	}
+}
+
+func TestRunTaskFatal(t *testing.T) {
+	d := NewDriver("default", "path").(*Driver)
+
+	calls := 0
+	err := d.runTask("test", func() (govcd.Task, error) {
+		calls++
+		return govcd.Task{}, errors.New("task aborted by user")
+	})
+	assert.EqualError(t, err, "task aborted by user")
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	p := retryPolicy{attempts: 3, wait: time.Millisecond}
+
+	calls := 0
+	err := p.do("test", isTransient, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("API Error: 503: unavailable")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = p.do("test", isTransient, func() error {
+		calls++
+		return errors.New("API Error: 503: unavailable")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = p.do("test", isTransient, func() error {
+		calls++
+		return errors.New("API Error: 400: bad request")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := retryPolicy{attempts: 10, wait: 2 * time.Second}
+	assert.True(t, p.delay(2) >= 2*time.Second && p.delay(2) < 4*time.Second)
+	assert.True(t, p.delay(4) >= 8*time.Second && p.delay(4) < 16*time.Second)
+	assert.True(t, p.delay(10) >= retryMaxWait && p.delay(10) < 2*retryMaxWait)
+}
+
+func TestRetryTransport(t *testing.T) {
+	var bodies []string
+	status := []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(status[len(bodies)-1])
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &retryTransport{next: http.DefaultTransport, policy: retryPolicy{attempts: 3, wait: time.Millisecond}}}
+
+	// Idempotent requests are retried with their body.
+	req, _ := http.NewRequest(http.MethodPut, server.URL, strings.NewReader("section"))
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"section", "section", "section"}, bodies)
+
+	// A POST is retried on 503 only, a 502 may hide a processed request.
+	bodies = nil
+	req, _ = http.NewRequest(http.MethodPost, server.URL, strings.NewReader("action"))
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Len(t, bodies, 2)
+}
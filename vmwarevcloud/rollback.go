@@ -0,0 +1,56 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"github.com/docker/machine/libmachine/log"
+)
+
+// rollback records how to undo every resource Create makes, so a failed
+// Create does not leave orphans behind.
+type rollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	name string
+	undo func() error
+}
+
+// add registers undo for the resource called name.
+func (r *rollback) add(name string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{name: name, undo: undo})
+}
+
+// run undoes the registered resources newest first. A failing step is
+// logged and does not stop the others, so as much as possible is removed.
+// It reports whether every step succeeded.
+func (r *rollback) run() bool {
+	ok := true
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		log.Infof("Rolling back %s...", step.name)
+		if err := step.undo(); err != nil {
+			log.Warnf("Unable to roll back %s: %s", step.name, err)
+			ok = false
+		}
+	}
+	r.steps = nil
+	return ok
+}
@@ -0,0 +1,52 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollbackRun(t *testing.T) {
+	var undone []string
+	undo := func(name string, err error) func() error {
+		return func() error {
+			undone = append(undone, name)
+			return err
+		}
+	}
+
+	r := &rollback{}
+	r.add("vApp", undo("vApp", nil))
+	r.add("NAT rules", undo("NAT rules", fmt.Errorf("edge busy")))
+	r.add("firewall rules", undo("firewall rules", nil))
+
+	assert.False(t, r.run())
+	assert.Equal(t, []string{"firewall rules", "NAT rules", "vApp"}, undone)
+
+	undone = nil
+	assert.True(t, r.run())
+	assert.Empty(t, undone)
+
+	r.add("vApp", undo("vApp", nil))
+	assert.True(t, r.run())
+	assert.Equal(t, []string{"vApp"}, undone)
+}
@@ -0,0 +1,219 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// sessionCacheDir is the directory under StorePath holding cached tokens.
+const sessionCacheDir = "vcd-sessions"
+
+// vcdConnection is an authenticated client with the machine's Org and VDC
+// already resolved.
+type vcdConnection struct {
+	client *govcd.VCDClient
+	org    *govcd.Org
+	vdc    *govcd.Vdc
+}
+
+// cachedSession is the on-disk form of a vCloud Director session token.
+type cachedSession struct {
+	AuthHeader string    `json:"authHeader"`
+	Token      string    `json:"token"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// vcdSession is a logged in client shared by the drivers of a process
+// using the same credentials, with the VDCs they resolved.
+type vcdSession struct {
+	client *govcd.VCDClient
+	org    *govcd.Org
+	vdcs   map[string]*govcd.Vdc
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[string]*vcdSession{}
+)
+
+// connect returns a connection to vCloud Director, reusing the one already
+// opened by this process or a session token cached on disk by a previous
+// one, and only logging in again when neither is usable.
+func (d *Driver) connect() (*vcdConnection, error) {
+	d.migratePassword()
+	key := d.sessionKey()
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	s, ok := sessions[key]
+	if !ok {
+		p, org, err := d.login()
+		if err != nil {
+			return nil, err
+		}
+		s = &vcdSession{client: p, org: org, vdcs: map[string]*govcd.Vdc{}}
+		sessions[key] = s
+	}
+
+	// The VDC is resolved per driver, machines sharing a session may
+	// live in different VDCs.
+	vdc, ok := s.vdcs[d.VDC]
+	if !ok {
+		var err error
+		if vdc, err = s.org.GetVDCByName(d.VDC, true); err != nil {
+			return nil, err
+		}
+		s.vdcs[d.VDC] = vdc
+	}
+
+	return &vcdConnection{client: s.client, org: s.org, vdc: vdc}, nil
+}
+
+// login opens a session with the cached token or else by authenticating.
+func (d *Driver) login() (*govcd.VCDClient, *govcd.Org, error) {
+	p := govcd.NewVCDClient(*d.Url, d.Insecure)
+	p.Client.Http.Transport = d.retryTransport(p.Client.Http.Transport)
+
+	org, err := d.restoreSession(p)
+	if err != nil {
+		log.Debugf("Cached vCloud Director session is not usable: %s", err)
+		log.Infof("Connecting to vCloud Director...")
+		// Authenticate to vCloud Director
+		if err = d.authenticate(p); err != nil {
+			return nil, nil, err
+		}
+
+		org, err = p.GetOrgByName(d.Org)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	d.saveSession(p)
+
+	return p, org, nil
+}
+
+// restoreSession loads the cached token into p and checks it is still
+// accepted by resolving the Org.
+func (d *Driver) restoreSession(p *govcd.VCDClient) (*govcd.Org, error) {
+	if d.SessionTTL <= 0 {
+		return nil, fmt.Errorf("session cache disabled")
+	}
+
+	s, err := readSessionCache(d.sessionCachePath())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.SetToken(d.Org, s.AuthHeader, s.Token); err != nil {
+		return nil, err
+	}
+
+	return p.GetOrgByName(d.Org)
+}
+
+// saveSession stores the token of p on disk. vCloud Director extends the
+// idle timeout of a session on every call, so the expiry is pushed forward
+// each time the session is used.
+func (d *Driver) saveSession(p *govcd.VCDClient) {
+	if d.SessionTTL <= 0 || p.Client.VCDToken == "" {
+		return
+	}
+
+	s := &cachedSession{
+		AuthHeader: p.Client.VCDAuthHeader,
+		Token:      p.Client.VCDToken,
+		ExpiresAt:  time.Now().Add(time.Duration(d.SessionTTL) * time.Minute),
+	}
+	if err := writeSessionCache(d.sessionCachePath(), s); err != nil {
+		log.Debugf("Unable to cache vCloud Director session: %s", err)
+	}
+}
+
+// sessionKey identifies the credentials a session belongs to, so machines
+// sharing an endpoint, Org and identity share one login.
+func (d *Driver) sessionKey() string {
+	sum := sha256.Sum256([]byte(d.Href + "\x00" + d.Org + "\x00" + d.credentialID()))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *Driver) sessionCachePath() string {
+	return filepath.Join(d.StorePath, sessionCacheDir, d.sessionKey()+".json")
+}
+
+func readSessionCache(path string) (*cachedSession, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &cachedSession{}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+
+	if s.Token == "" || time.Now().After(s.ExpiresAt) {
+		return nil, fmt.Errorf("cached session expired")
+	}
+
+	return s, nil
+}
+
+func writeSessionCache(path string, s *cachedSession) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Several docker-machine processes may refresh the same session at once,
+	// so write to a private file and rename it into place.
+	f, err := ioutil.TempFile(filepath.Dir(path), ".session-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,89 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+)
+
+func TestSessionCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vcd-session")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, sessionCacheDir, "key.json")
+
+	err = writeSessionCache(path, &cachedSession{
+		AuthHeader: "X-Vmware-Vcloud-Access-Token",
+		Token:      "token",
+		ExpiresAt:  time.Now().Add(time.Minute),
+	})
+	assert.NoError(t, err)
+
+	s, err := readSessionCache(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "token", s.Token)
+
+	err = writeSessionCache(path, &cachedSession{
+		Token:     "token",
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+	assert.NoError(t, err)
+
+	_, err = readSessionCache(path)
+	assert.Error(t, err)
+}
+
+func TestSessionKey(t *testing.T) {
+	a := NewDriver("a", "path").(*Driver)
+	b := NewDriver("b", "path").(*Driver)
+	a.Href, a.Org, a.UserName = "https://example.com/api", "org", "root"
+	b.Href, b.Org, b.UserName = "https://example.com/api", "org", "root"
+
+	assert.Equal(t, a.sessionKey(), b.sessionKey())
+
+	b.UserName = "other"
+	assert.NotEqual(t, a.sessionKey(), b.sessionKey())
+}
+
+func TestConnectResolvesVDCPerDriver(t *testing.T) {
+	a := NewDriver("a", "path").(*Driver)
+	b := NewDriver("b", "path").(*Driver)
+	a.Href, a.Org, a.UserName, a.VDC = "https://example.com/api", "org", "root", "vdc-a"
+	b.Href, b.Org, b.UserName, b.VDC = "https://example.com/api", "org", "root", "vdc-b"
+
+	vdcA, vdcB := &govcd.Vdc{}, &govcd.Vdc{}
+	sessions[a.sessionKey()] = &vcdSession{vdcs: map[string]*govcd.Vdc{"vdc-a": vdcA, "vdc-b": vdcB}}
+	defer delete(sessions, a.sessionKey())
+
+	c, err := a.connect()
+	assert.NoError(t, err)
+	assert.True(t, c.vdc == vdcA)
+
+	c, err = b.connect()
+	assert.NoError(t, err)
+	assert.True(t, c.vdc == vdcB)
+}
@@ -0,0 +1,94 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"encoding/xml"
+	"net/http"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// mimeCreateSnapshotParams is the content type of createSnapshotParams.
+const mimeCreateSnapshotParams = "application/vnd.vmware.vcloud.createSnapshotParams+xml"
+
+// createSnapshotParams is the body of the VM createSnapshot action.
+// vCloud Director keeps a single snapshot per VM, a new one replaces it.
+type createSnapshotParams struct {
+	XMLName     xml.Name `xml:"CreateSnapshotParams"`
+	Xmlns       string   `xml:"xmlns,attr"`
+	Memory      bool     `xml:"memory,attr"`
+	Quiesce     bool     `xml:"quiesce,attr"`
+	Name        string   `xml:"name,attr,omitempty"`
+	Description string   `xml:"Description,omitempty"`
+}
+
+// CreateSnapshot takes a snapshot of the machine, replacing the previous
+// one. memory includes the memory state, quiesce quiesces the guest file
+// systems through VMware Tools.
+func (d *Driver) CreateSnapshot(name string, memory, quiesce bool) error {
+	params := &createSnapshotParams{
+		Xmlns:       types.XMLNamespaceVCloud,
+		Memory:      memory,
+		Quiesce:     quiesce,
+		Name:        name,
+		Description: "Created by docker-machine for " + d.MachineName,
+	}
+
+	log.Infof("Creating snapshot %s of %s...", name, d.MachineName)
+	return d.snapshotAction("createSnapshot", mimeCreateSnapshotParams, "error creating snapshot: %s", params)
+}
+
+// RevertSnapshot reverts the machine to its snapshot.
+func (d *Driver) RevertSnapshot() error {
+	log.Infof("Reverting %s to its snapshot...", d.MachineName)
+	return d.snapshotAction("revertToCurrentSnapshot", "", "error reverting snapshot: %s", nil)
+}
+
+// RemoveSnapshot removes the snapshot of the machine.
+func (d *Driver) RemoveSnapshot() error {
+	log.Infof("Removing the snapshot of %s...", d.MachineName)
+	return d.snapshotAction("removeAllSnapshots", "", "error removing snapshot: %s", nil)
+}
+
+// snapshotAction runs a snapshot action on the VM of the machine's vApp
+// and waits for it to complete.
+func (d *Driver) snapshotAction(action, contentType, errorMessage string, payload interface{}) error {
+	c, err := d.connect()
+	if err != nil {
+		return err
+	}
+
+	vapp, err := c.vdc.GetVAppById(d.VAppID, true)
+	if err != nil {
+		return err
+	}
+	vm, err := d.machineVM(vapp)
+	if err != nil {
+		return err
+	}
+
+	href := vm.HREF + "/action/" + action
+	return d.runTask(action+" of "+d.MachineName, func() (govcd.Task, error) {
+		return c.client.Client.ExecuteTaskRequest(href, http.MethodPost, contentType, errorMessage, payload)
+	})
+}
@@ -0,0 +1,45 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateSnapshotParams(t *testing.T) {
+	params := &createSnapshotParams{
+		Xmlns:       types.XMLNamespaceVCloud,
+		Memory:      true,
+		Name:        "before-remove",
+		Description: "Created by docker-machine for default",
+	}
+
+	data, err := xml.Marshal(params)
+	assert.NoError(t, err)
+	assert.Equal(t, `<CreateSnapshotParams xmlns="http://www.vmware.com/vcloud/v1.5" memory="true" quiesce="false" name="before-remove"><Description>Created by docker-machine for default</Description></CreateSnapshotParams>`, string(data))
+
+	data, err = xml.Marshal(&createSnapshotParams{Xmlns: types.XMLNamespaceVCloud})
+	assert.NoError(t, err)
+	assert.Equal(t, `<CreateSnapshotParams xmlns="http://www.vmware.com/vcloud/v1.5" memory="false" quiesce="false"></CreateSnapshotParams>`, string(data))
+}
@@ -0,0 +1,110 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"strings"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+// vcdStates maps vCloud Director vApp and VM statuses to machine states.
+var vcdStates = map[string]state.State{
+	"FAILED_CREATION":    state.Error,
+	"UNRESOLVED":         state.Starting,
+	"RESOLVED":           state.Stopped,
+	"DEPLOYED":           state.Stopped,
+	"SUSPENDED":          state.Saved,
+	"POWERED_ON":         state.Running,
+	"WAITING_FOR_INPUT":  state.Paused,
+	"UNKNOWN":            state.None,
+	"UNRECOGNIZED":       state.None,
+	"POWERED_OFF":        state.Stopped,
+	"INCONSISTENT_STATE": state.Error,
+	"MIXED":              state.None,
+}
+
+// Substrings of task operation names, lower cased, telling which way a
+// machine with a task in progress is heading.
+var (
+	stoppingOperations = []string{"poweroff", "shutdown", "undeploy", "suspend"}
+	startingOperations = []string{"poweron", "deploy", "reboot", "reset", "compose", "instantiate", "create"}
+)
+
+// vappState returns the state of the machine in vapp. A vApp holding a
+// single VM reports the state of that VM, as the vApp status lags behind.
+// A task in progress overrides the status with Starting or Stopping.
+func vappState(vapp *govcd.VApp) state.State {
+	status := vapp.VApp.Status
+	tasks := []*types.TasksInProgress{vapp.VApp.Tasks}
+
+	if vapp.VApp.Children != nil && len(vapp.VApp.Children.VM) == 1 {
+		vm := vapp.VApp.Children.VM[0]
+		status = vm.Status
+		tasks = append(tasks, vm.Tasks)
+	}
+
+	for _, t := range tasks {
+		if s, busy := taskState(t); busy {
+			return s
+		}
+	}
+
+	return statusState(types.VAppStatuses[status])
+}
+
+// statusState maps a vCloud Director status name to a machine state.
+func statusState(status string) state.State {
+	if s, ok := vcdStates[status]; ok {
+		return s
+	}
+	return state.None
+}
+
+// taskState reports whether a task is in progress and, if so, the state
+// the machine is moving to.
+func taskState(tasks *types.TasksInProgress) (state.State, bool) {
+	if tasks == nil {
+		return state.None, false
+	}
+
+	for _, task := range tasks.Task {
+		if task.Status != "running" && task.Status != "queued" && task.Status != "preRunning" {
+			continue
+		}
+
+		operation := strings.ToLower(task.OperationName)
+		// Check stopping first, "undeploy" also contains "deploy".
+		for _, op := range stoppingOperations {
+			if strings.Contains(operation, op) {
+				return state.Stopping, true
+			}
+		}
+		for _, op := range startingOperations {
+			if strings.Contains(operation, op) {
+				return state.Starting, true
+			}
+		}
+	}
+
+	return state.None, false
+}
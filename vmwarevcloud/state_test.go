@@ -0,0 +1,52 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"testing"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/docker/machine/libmachine/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusState(t *testing.T) {
+	assert.Equal(t, state.Running, statusState("POWERED_ON"))
+	assert.Equal(t, state.Stopped, statusState("POWERED_OFF"))
+	assert.Equal(t, state.Saved, statusState("SUSPENDED"))
+	assert.Equal(t, state.Error, statusState("FAILED_CREATION"))
+	assert.Equal(t, state.None, statusState("SOMETHING_NEW"))
+}
+
+func TestVAppStateUsesVMAndTasks(t *testing.T) {
+	vapp := &govcd.VApp{VApp: &types.VApp{
+		Status: 10, // MIXED
+		Children: &types.VAppChildren{VM: []*types.Vm{
+			{Status: 4}, // POWERED_ON
+		}},
+	}}
+	assert.Equal(t, state.Running, vappState(vapp))
+
+	vapp.VApp.Children.VM[0].Tasks = &types.TasksInProgress{Task: []*types.Task{
+		{Status: "running", OperationName: "vappUndeployPowerOff"},
+	}}
+	assert.Equal(t, state.Stopping, vappState(vapp))
+}
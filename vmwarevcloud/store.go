@@ -0,0 +1,69 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/mcnutils"
+)
+
+// machineConfig is the part of a docker-machine host config.json the
+// driver needs to act on a machine outside of docker-machine.
+type machineConfig struct {
+	DriverName string
+	Driver     json.RawMessage
+}
+
+// DefaultStorePath returns the docker-machine store, honouring
+// MACHINE_STORAGE_PATH like docker-machine does.
+func DefaultStorePath() string {
+	if path := os.Getenv("MACHINE_STORAGE_PATH"); path != "" {
+		return path
+	}
+	return filepath.Join(mcnutils.GetHomeDir(), ".docker", "machine")
+}
+
+// LoadDriver reads the driver of machine name from the docker-machine
+// store at storePath.
+func LoadDriver(storePath, name string) (*Driver, error) {
+	data, err := ioutil.ReadFile(filepath.Join(storePath, "machines", name, "config.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read machine %s: %s", name, err)
+	}
+
+	config := &machineConfig{}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Unable to parse machine %s: %s", name, err)
+	}
+	if config.DriverName != "vcd" {
+		return nil, fmt.Errorf("Machine %s uses the %s driver, not vcd", name, config.DriverName)
+	}
+
+	d := NewDriver(name, storePath).(*Driver)
+	if err = json.Unmarshal(config.Driver, d); err != nil {
+		return nil, fmt.Errorf("Unable to parse the driver of machine %s: %s", name, err)
+	}
+
+	return d, nil
+}
@@ -20,12 +20,14 @@
 package vmwarevcloud
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/url"
-	"strconv"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
@@ -43,31 +45,67 @@ import (
 
 type Driver struct {
 	*drivers.BaseDriver
-	UserName       string
-	UserPassword   string
-	VDC            string
-	OrgVDCNet      string
-	EdgeGateway    string
-	VdcEdgeGateway string
-	PublicIP       string
-	PrivateIP      string
-	Catalog        string
-	CatalogItem    string
-	StorProfile    string
-	UserData       string
-	InitData       string
-	AdapterType    string
+	UserName                string
+	UserPassword            string `json:",omitempty"`
+	PasswordSource          string
+	APIToken                string `json:",omitempty"`
+	APITokenSource          string
+	Token                   string `json:",omitempty"`
+	TokenSource             string
+	ServiceAccountTokenFile string
+	VDC                     string
+	OrgVDCNet               string
+	EdgeGateway             string
+	VdcEdgeGateway          string
+	EdgeType                string
+	PublicIP                string
+	PrivateIP               string
+	Catalog                 string
+	CatalogItem             string
+	StorProfile             string
+	UserData                string
+	InitData                string
+	AdapterType             string
 	IPAddressAllocationMode string
-	DockerPort     int
-	CPUCount       int
-	MemorySize     int
-	DiskSize       int
-	VAppID         string
-	Href           string
-	Url            *url.URL
-	Org            string
-	Insecure       bool
-	Rke2           bool
+	StaticIP                string
+	Gateway                 string
+	Netmask                 string
+	DNS                     []string
+	Networks                []string
+	PrimaryNIC              int
+	NICUpdate               string
+	IPv6                    bool
+	PreferIPv6              bool
+	PrivateIPv6             string
+	EndpointAddress         string
+	NatMode                 string
+	PortRange               string
+	ExternalSSHPort         int
+	ExternalDockerPort      int
+	AllowedPorts            []string
+	AllowedCIDRs            []string
+	DockerPort              int
+	CPUCount                int
+	MemorySize              int
+	DiskSize                int
+	VAppID                  string
+	Href                    string
+	Url                     *url.URL
+	Org                     string
+	Insecure                bool
+	Rke2                    bool
+	SessionTTL              int
+	CreateTimeout           int
+	IPTimeout               int
+	KeepOnFailure           bool
+	Ledger                  Ledger
+	ShutdownTimeout         int
+	StopUndeploy            bool
+	RestartMode             string
+	RebootTimeout           int
+	RetryAttempts           int
+	RetryWait               int
+	SnapshotBeforeRemove    bool
 }
 
 type RancherCloudInit struct {
@@ -81,18 +119,31 @@ type RancherCloudInit struct {
 }
 
 const (
-	defaultCatalog     = "Public Catalog"
-	defaultCatalogItem = "Ubuntu Server 12.04 LTS (amd64 20150127)"
-	defaultCpus        = 2
-	defaultMemory      = 2048
-	defaultDisk        = 20480
-	defaultSSHPort     = 22
-	defaultDockerPort  = 2376
-	defaultInsecure    = false
-	defaultRke2        = false
-	defaultSSHUser     = "docker"
-	defaultAdapterType = ""
+	defaultCatalog                 = "Public Catalog"
+	defaultCatalogItem             = "Ubuntu Server 12.04 LTS (amd64 20150127)"
+	defaultCpus                    = 2
+	defaultMemory                  = 2048
+	defaultDisk                    = 20480
+	defaultSSHPort                 = 22
+	defaultDockerPort              = 2376
+	defaultInsecure                = false
+	defaultRke2                    = false
+	defaultSSHUser                 = "docker"
+	defaultAdapterType             = ""
 	defaultIPAddressAllocationMode = types.IPAllocationModeDHCP
+	defaultSessionTTL              = 25
+	defaultCreateTimeout           = 600
+	defaultIPTimeout               = 600
+	defaultShutdownTimeout         = 300
+	defaultRestartMode             = restartModeReboot
+	defaultRebootTimeout           = 300
+	defaultRetryAttempts           = 5
+	defaultRetryWait               = 2
+	defaultNICUpdate               = nicUpdateReplace
+	defaultNatMode                 = natMode1to1
+	defaultEdgeType                = edgeTypeAuto
+	defaultEndpointAddress         = endpointAuto
+	defaultPortRange               = "20000-29999"
 )
 
 func takeIntAddress(x int) *int {
@@ -103,6 +154,13 @@ func takeBoolPointer(value bool) *bool {
 	return &value
 }
 
+// defaultIfZero sets *value to def when it was left unset.
+func defaultIfZero(value *int, def int) {
+	if *value == 0 {
+		*value = def
+	}
+}
+
 // GetCreateFlags registers the flags this driver adds to
 // "docker hosts create"
 func (d *Driver) GetCreateFlags() []mcnflag.Flag {
@@ -117,6 +175,41 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Name:   "vcd-password",
 			Usage:  "vCloud Director password",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_PASSWORD_SOURCE",
+			Name:   "vcd-password-source",
+			Usage:  "vCloud Director password source: env:<variable>, file:<path> or helper:<docker credential helper>; only the reference is stored",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "VCD_STORE_SECRETS",
+			Name:   "vcd-store-secrets",
+			Usage:  "vCloud Director store -vcd-password, -vcd-api-token and -vcd-token in plaintext in the machine config, instead of using a source",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_API_TOKEN",
+			Name:   "vcd-api-token",
+			Usage:  "vCloud Director API token (refresh token), alternative to username/password",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_API_TOKEN_SOURCE",
+			Name:   "vcd-api-token-source",
+			Usage:  "vCloud Director API token source, same syntax as -vcd-password-source; only the reference is stored",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_TOKEN",
+			Name:   "vcd-token",
+			Usage:  "vCloud Director bearer or session token, alternative to username/password",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_TOKEN_SOURCE",
+			Name:   "vcd-token-source",
+			Usage:  "vCloud Director bearer or session token source, same syntax as -vcd-password-source; only the reference is stored",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_SERVICE_ACCOUNT_TOKEN_FILE",
+			Name:   "vcd-service-account-token-file",
+			Usage:  "vCloud Director service account token file, rewritten when the token is rotated",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "VCD_VDC",
 			Name:   "vcd-vdc",
@@ -149,15 +242,95 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "vCloud Director IP Address Allocation Mode like DHCP",
 			Value:  defaultIPAddressAllocationMode,
 		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_IP_ADDRESS",
+			Name:   "vcd-ip-address",
+			Usage:  "vCloud Director static IP address of the VM, implies MANUAL allocation mode",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_GATEWAY",
+			Name:   "vcd-gateway",
+			Usage:  "vCloud Director default gateway applied by guest customization (default from the network)",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_NETMASK",
+			Name:   "vcd-netmask",
+			Usage:  "vCloud Director netmask applied by guest customization (default from the network)",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "VCD_DNS",
+			Name:   "vcd-dns",
+			Usage:  "vCloud Director DNS server applied by guest customization, repeatable (default from the network)",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "VCD_NETWORK",
+			Name:   "vcd-network",
+			Usage:  "vCloud Director network adapter as name[:adapter][:mode][:ip], repeatable, replaces -vcd-orgvdcnetwork",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "VCD_PRIMARY_NIC",
+			Name:   "vcd-primary-nic",
+			Usage:  "vCloud Director index of the -vcd-network adapter used to reach the machine (default 0)",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_NIC_UPDATE",
+			Name:   "vcd-nic-update",
+			Usage:  "vCloud Director how to apply adapter types: replace (recreate all NICs) or in-place (keep MACs and extra template NICs)",
+			Value:  defaultNICUpdate,
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "VCD_IPV6",
+			Name:   "vcd-ipv6",
+			Usage:  "vCloud Director also allocate an IPv6 address on networks with an IPv6 subnet",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "VCD_PREFER_IPV6",
+			Name:   "vcd-prefer-ipv6",
+			Usage:  "vCloud Director reach SSH and Docker over the IPv6 address of the primary NIC (implies -vcd-ipv6)",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "VCD_EDGEGATEWAY",
 			Name:   "vcd-edgegateway",
-			Usage:  "vCloud Director Edge Gateway (Default is <vdc>)",
+			Usage:  "vCloud Director Edge Gateway (Default is the one the network is routed through)",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_EDGE_TYPE",
+			Name:   "vcd-edge-type",
+			Usage:  "vCloud Director Edge Gateway type: auto, nsxt or nsxv",
+			Value:  defaultEdgeType,
 		},
 		mcnflag.StringFlag{
 			EnvVar: "VCD_PUBLICIP",
 			Name:   "vcd-publicip",
-			Usage:  "vCloud Director Org Public IP to use",
+			Usage:  "vCloud Director Org Public IP to use, or auto to pick a free one of the edge gateway",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_ENDPOINT_ADDRESS",
+			Name:   "vcd-endpoint-address",
+			Usage:  "vCloud Director address docker-machine reaches the machine on: private, public (NAT-translated) or auto (public when mapped)",
+			Value:  defaultEndpointAddress,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_NAT_MODE",
+			Name:   "vcd-nat-mode",
+			Usage:  "vCloud Director NAT of the public IP: 1to1 (whole address) or port-forward (shared address, one external port each for SSH and Docker)",
+			Value:  defaultNatMode,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_PORT_RANGE",
+			Name:   "vcd-port-range",
+			Usage:  "vCloud Director range of external ports to pick from in port-forward mode",
+			Value:  defaultPortRange,
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "VCD_ALLOWED_PORT",
+			Name:   "vcd-allowed-port",
+			Usage:  "vCloud Director extra TCP port to open on the edge gateway firewall besides SSH and Docker in 1to1 NAT mode, repeatable",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "VCD_ALLOWED_CIDR",
+			Name:   "vcd-allowed-cidr",
+			Usage:  "vCloud Director source CIDR allowed through the edge gateway firewall, repeatable (default any)",
 		},
 		mcnflag.StringFlag{
 			EnvVar: "VCD_CATALOG",
@@ -186,6 +359,69 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Name:   "vcd-insecure",
 			Usage:  "vCloud Director allow non secure connections",
 		},
+		mcnflag.IntFlag{
+			EnvVar: "VCD_SESSION_TTL",
+			Name:   "vcd-session-ttl",
+			Usage:  "vCloud Director session cache lifetime in minutes, 0 disables the cache (default 25)",
+			Value:  defaultSessionTTL,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "VCD_CREATE_TIMEOUT",
+			Name:   "vcd-create-timeout",
+			Usage:  "vCloud Director seconds to wait for each VM creation phase (default 600)",
+			Value:  defaultCreateTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "VCD_IP_TIMEOUT",
+			Name:   "vcd-ip-timeout",
+			Usage:  "vCloud Director seconds to wait for the VM to get an IP address (default 600)",
+			Value:  defaultIPTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "VCD_SHUTDOWN_TIMEOUT",
+			Name:   "vcd-shutdown-timeout",
+			Usage:  "vCloud Director seconds to wait for a guest shutdown before powering off (default 300)",
+			Value:  defaultShutdownTimeout,
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "VCD_STOP_UNDEPLOY",
+			Name:   "vcd-stop-undeploy",
+			Usage:  "vCloud Director undeploy the vApp on stop to release its resources",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_RESTART_MODE",
+			Name:   "vcd-restart-mode",
+			Usage:  "vCloud Director restart mode: reboot (guest reboot, reset on timeout) or reset",
+			Value:  defaultRestartMode,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "VCD_REBOOT_TIMEOUT",
+			Name:   "vcd-reboot-timeout",
+			Usage:  "vCloud Director seconds to wait for a guest reboot before resetting (default 300)",
+			Value:  defaultRebootTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "VCD_RETRY_ATTEMPTS",
+			Name:   "vcd-retry-attempts",
+			Usage:  "vCloud Director attempts of an API call failing with a transient error (default 5)",
+			Value:  defaultRetryAttempts,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "VCD_RETRY_WAIT",
+			Name:   "vcd-retry-wait",
+			Usage:  "vCloud Director seconds to wait before retrying an API call, doubled on each retry (default 2)",
+			Value:  defaultRetryWait,
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "VCD_SNAPSHOT_BEFORE_REMOVE",
+			Name:   "vcd-snapshot-before-remove",
+			Usage:  "vCloud Director snapshot the VM before removing it, to revert a removal that fails half way",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "VCD_KEEP_ON_FAILURE",
+			Name:   "vcd-keep-on-failure",
+			Usage:  "vCloud Director keep a partially created machine instead of rolling it back, for debugging",
+		},
 		mcnflag.BoolFlag{
 			EnvVar: "VCD_RKE2",
 			Name:   "vcd-rke2",
@@ -244,16 +480,28 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 
 func NewDriver(hostName, storePath string) drivers.Driver {
 	return &Driver{
-		Catalog:     defaultCatalog,
-		CatalogItem: defaultCatalogItem,
-		CPUCount:    defaultCpus,
-		MemorySize:  defaultMemory,
-		DiskSize:    defaultDisk,
-		DockerPort:  defaultDockerPort,
-		Insecure:    defaultInsecure,
-		Rke2:        defaultRke2,
-		AdapterType: defaultAdapterType,
+		Catalog:                 defaultCatalog,
+		CatalogItem:             defaultCatalogItem,
+		CPUCount:                defaultCpus,
+		MemorySize:              defaultMemory,
+		DiskSize:                defaultDisk,
+		DockerPort:              defaultDockerPort,
+		Insecure:                defaultInsecure,
+		Rke2:                    defaultRke2,
+		AdapterType:             defaultAdapterType,
 		IPAddressAllocationMode: defaultIPAddressAllocationMode,
+		SessionTTL:              defaultSessionTTL,
+		CreateTimeout:           defaultCreateTimeout,
+		IPTimeout:               defaultIPTimeout,
+		ShutdownTimeout:         defaultShutdownTimeout,
+		RestartMode:             defaultRestartMode,
+		RebootTimeout:           defaultRebootTimeout,
+		RetryAttempts:           defaultRetryAttempts,
+		RetryWait:               defaultRetryWait,
+		NICUpdate:               defaultNICUpdate,
+		NatMode:                 defaultNatMode,
+		EdgeType:                defaultEdgeType,
+		PortRange:               defaultPortRange,
 		BaseDriver: &drivers.BaseDriver{
 			SSHPort:     defaultSSHPort,
 			MachineName: hostName,
@@ -275,22 +523,175 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 
 	d.UserName = flags.String("vcd-username")
 	d.UserPassword = flags.String("vcd-password")
+	d.PasswordSource = flags.String("vcd-password-source")
+	d.APIToken = flags.String("vcd-api-token")
+	d.APITokenSource = flags.String("vcd-api-token-source")
+	d.Token = flags.String("vcd-token")
+	d.TokenSource = flags.String("vcd-token-source")
+	d.ServiceAccountTokenFile = flags.String("vcd-service-account-token-file")
 	d.VDC = flags.String("vcd-vdc")
 	d.Org = flags.String("vcd-org")
 	d.Href = flags.String("vcd-href")
 	d.Insecure = flags.Bool("vcd-insecure")
 	d.Rke2 = flags.Bool("vcd-rke2")
+	d.SessionTTL = flags.Int("vcd-session-ttl")
+	d.CreateTimeout = flags.Int("vcd-create-timeout")
+	d.IPTimeout = flags.Int("vcd-ip-timeout")
+	d.KeepOnFailure = flags.Bool("vcd-keep-on-failure")
+	d.ShutdownTimeout = flags.Int("vcd-shutdown-timeout")
+	d.StopUndeploy = flags.Bool("vcd-stop-undeploy")
+	d.RestartMode = flags.String("vcd-restart-mode")
+	d.RebootTimeout = flags.Int("vcd-reboot-timeout")
+	d.RetryAttempts = flags.Int("vcd-retry-attempts")
+	d.RetryWait = flags.Int("vcd-retry-wait")
+	d.SnapshotBeforeRemove = flags.Bool("vcd-snapshot-before-remove")
 	d.PublicIP = flags.String("vcd-publicip")
+	d.NatMode = flags.String("vcd-nat-mode")
+	d.EdgeType = flags.String("vcd-edge-type")
+	d.EndpointAddress = flags.String("vcd-endpoint-address")
+	d.PortRange = flags.String("vcd-port-range")
+	d.AllowedPorts = flags.StringSlice("vcd-allowed-port")
+	d.AllowedCIDRs = flags.StringSlice("vcd-allowed-cidr")
 	d.StorProfile = flags.String("vcd-storprofile")
 	d.UserData = flags.String("vcd-user-data")
 	d.InitData = flags.String("vcd-init-data")
 	d.AdapterType = flags.String("vcd-networkadaptertype")
 	d.IPAddressAllocationMode = flags.String("vcd-ipaddressallocationmode")
+	d.StaticIP = flags.String("vcd-ip-address")
+	d.Gateway = flags.String("vcd-gateway")
+	d.Netmask = flags.String("vcd-netmask")
+	d.DNS = flags.StringSlice("vcd-dns")
+	d.Networks = flags.StringSlice("vcd-network")
+	d.PrimaryNIC = flags.Int("vcd-primary-nic")
+	d.NICUpdate = flags.String("vcd-nic-update")
+	d.IPv6 = flags.Bool("vcd-ipv6")
+	d.PreferIPv6 = flags.Bool("vcd-prefer-ipv6")
 	d.SetSwarmConfigFromFlags(flags)
 
+	if d.PasswordSource != "" && d.UserName == "" && !strings.HasPrefix(d.PasswordSource, secretSourceHelper+":") {
+		return fmt.Errorf("Please specify -vcd-username, only helper: password sources supply it")
+	}
+
 	// Check for required Params
-	if d.UserName == "" || d.UserPassword == "" || d.Href == "" || d.VDC == "" || d.Org == "" || d.StorProfile == "" {
-		return fmt.Errorf("Please specify vclouddirector mandatory params using options: -vcd-username -vcd-password -vcd-vdc -vcd-href -vcd-org and -vcd-storprofile")
+	if d.credentialSets() == 0 || d.Href == "" || d.VDC == "" || d.Org == "" || d.StorProfile == "" {
+		return fmt.Errorf("Please specify vclouddirector mandatory params using options: -vcd-username -vcd-password (or -vcd-password-source, -vcd-api-token[-source], -vcd-token[-source], -vcd-service-account-token-file) -vcd-vdc -vcd-href -vcd-org and -vcd-storprofile")
+	}
+
+	// Secrets given directly can only be stored in the machine config as
+	// given, so they need an explicit opt-in. Secrets given by source are
+	// resolved on every login.
+	storeSecrets := flags.Bool("vcd-store-secrets")
+	secrets := []struct{ value, source, flag string }{
+		{d.UserPassword, d.PasswordSource, "vcd-password"},
+		{d.APIToken, d.APITokenSource, "vcd-api-token"},
+		{d.Token, d.TokenSource, "vcd-token"},
+	}
+	for _, s := range secrets {
+		if s.source != "" {
+			if s.value != "" {
+				return fmt.Errorf("Please specify only one of -%s and -%s-source", s.flag, s.flag)
+			}
+			if _, _, err := parseSecretSource(s.source); err != nil {
+				return err
+			}
+		} else if s.value != "" {
+			if !storeSecrets {
+				return fmt.Errorf("-%s would be stored in plaintext in the machine config, use -%s-source or pass -vcd-store-secrets", s.flag, s.flag)
+			}
+			log.Warnf("The value of -%s will be stored in plaintext in the machine config", s.flag)
+		}
+	}
+
+	if d.credentialSets() > 1 {
+		return fmt.Errorf("Please specify only one of -vcd-username/-vcd-password, -vcd-api-token, -vcd-token or -vcd-service-account-token-file")
+	}
+
+	if d.CreateTimeout < 0 || d.IPTimeout < 0 || d.ShutdownTimeout < 0 || d.RebootTimeout < 0 {
+		return fmt.Errorf("Please specify positive -vcd-create-timeout, -vcd-ip-timeout, -vcd-shutdown-timeout and -vcd-reboot-timeout values")
+	}
+	if d.RetryAttempts < 0 || d.RetryWait < 0 {
+		return fmt.Errorf("Please specify positive -vcd-retry-attempts and -vcd-retry-wait values")
+	}
+
+	// Timeouts and modes left unset keep their defaults.
+	defaultIfZero(&d.CreateTimeout, defaultCreateTimeout)
+	defaultIfZero(&d.IPTimeout, defaultIPTimeout)
+	defaultIfZero(&d.ShutdownTimeout, defaultShutdownTimeout)
+	defaultIfZero(&d.RebootTimeout, defaultRebootTimeout)
+	defaultIfZero(&d.RetryAttempts, defaultRetryAttempts)
+	defaultIfZero(&d.RetryWait, defaultRetryWait)
+	if d.RestartMode == "" {
+		d.RestartMode = defaultRestartMode
+	}
+	if d.NICUpdate == "" {
+		d.NICUpdate = defaultNICUpdate
+	}
+	if d.NatMode == "" {
+		d.NatMode = defaultNatMode
+	}
+	if d.PortRange == "" {
+		d.PortRange = defaultPortRange
+	}
+	if d.EdgeType == "" {
+		d.EdgeType = defaultEdgeType
+	}
+	if d.EndpointAddress == "" {
+		d.EndpointAddress = defaultEndpointAddress
+	}
+
+	if d.RestartMode != restartModeReboot && d.RestartMode != restartModeReset {
+		return fmt.Errorf("Invalid -vcd-restart-mode %q, expected reboot or reset", d.RestartMode)
+	}
+
+	switch d.EdgeType {
+	case edgeTypeAuto, edgeTypeNsxt, edgeTypeNsxv:
+	default:
+		return fmt.Errorf("Invalid -vcd-edge-type %q, expected auto, nsxt or nsxv", d.EdgeType)
+	}
+
+	if d.NICUpdate != nicUpdateReplace && d.NICUpdate != nicUpdateInPlace {
+		return fmt.Errorf("Invalid -vcd-nic-update %q, expected replace or in-place", d.NICUpdate)
+	}
+
+	if d.PreferIPv6 {
+		d.IPv6 = true
+	}
+
+	switch d.EndpointAddress {
+	case endpointAuto, endpointPrivate:
+	case endpointPublic:
+		if d.PublicIP == "" {
+			return fmt.Errorf("-vcd-endpoint-address public needs -vcd-publicip")
+		}
+	default:
+		return fmt.Errorf("Invalid -vcd-endpoint-address %q, expected private, public or auto", d.EndpointAddress)
+	}
+
+	switch d.NatMode {
+	case natMode1to1:
+	case natModePortForward:
+		if d.PublicIP == "" {
+			return fmt.Errorf("-vcd-nat-mode port-forward needs -vcd-publicip")
+		}
+		if _, _, err := parsePortRange(d.PortRange); err != nil {
+			return err
+		}
+		if len(d.AllowedPorts) > 0 {
+			return fmt.Errorf("-vcd-allowed-port needs -vcd-nat-mode 1to1, port-forward only forwards SSH and Docker")
+		}
+	default:
+		return fmt.Errorf("Invalid -vcd-nat-mode %q, expected 1to1 or port-forward", d.NatMode)
+	}
+
+	if _, err := parseAllowedPorts(d.AllowedPorts); err != nil {
+		return err
+	}
+	if err := checkAllowedCIDRs(d.AllowedCIDRs); err != nil {
+		return err
+	}
+
+	if err := d.checkAddressing(); err != nil {
+		return err
 	}
 
 	u, err := url.ParseRequestURI(d.Href)
@@ -306,6 +707,23 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 		d.OrgVDCNet = flags.String("vcd-orgvdcnetwork")
 	}
 
+	if len(d.Networks) > 0 {
+		if d.StaticIP != "" || d.AdapterType != "" {
+			return fmt.Errorf("Please give the adapter type and IP address in -vcd-network instead of -vcd-networkadaptertype and -vcd-ip-address")
+		}
+
+		nics, err := d.nicSpecs()
+		if err != nil {
+			return err
+		}
+		if d.PrimaryNIC < 0 || d.PrimaryNIC >= len(nics) {
+			return fmt.Errorf("Invalid -vcd-primary-nic %d, there are %d networks", d.PrimaryNIC, len(nics))
+		}
+		d.OrgVDCNet = nics[d.PrimaryNIC].Network
+	} else if d.PrimaryNIC != 0 {
+		return fmt.Errorf("-vcd-primary-nic needs -vcd-network")
+	}
+
 	// If the Edge Gateway is empty, just set it to the default edge gateway.
 	// if flags.String("vcd-edgegateway") == "" {
 	// 	d.EdgeGateway = flags.String("vcd-org")
@@ -324,8 +742,6 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.CPUCount = flags.Int("vcd-cpu-count")
 	d.MemorySize = flags.Int("vcd-memory-size")
 	d.DiskSize = flags.Int("vcd-disk-size")
-	d.PrivateIP = d.PublicIP
-
 	return nil
 }
 
@@ -334,86 +750,124 @@ func (d *Driver) GetURL() (string, error) {
 		return "", err
 	}
 
-	return fmt.Sprintf("tcp://%s", net.JoinHostPort(d.PrivateIP, strconv.Itoa(d.DockerPort))), nil
+	ip, err := d.GetIP()
+	if err != nil {
+		return "", err
+	}
+	if d.ExternalDockerPort != 0 && d.usePublicIP() {
+		return dockerURL(ip, d.ExternalDockerPort), nil
+	}
+	return dockerURL(ip, d.DockerPort), nil
+}
+
+// GetSSHPort returns the external SSH port when the machine is reached on
+// a shared public IP and the SSH port of the machine otherwise.
+func (d *Driver) GetSSHPort() (int, error) {
+	if d.ExternalSSHPort != 0 && d.usePublicIP() {
+		return d.ExternalSSHPort, nil
+	}
+	return d.BaseDriver.GetSSHPort()
 }
 
+// GetIP returns the address selected by -vcd-endpoint-address.
 func (d *Driver) GetIP() (string, error) {
+	if d.usePublicIP() {
+		if d.PublicIP == publicIPAuto {
+			return "", fmt.Errorf("The public IP of the machine is not reserved yet")
+		}
+		return d.PublicIP, nil
+	}
+	if d.PreferIPv6 && d.PrivateIPv6 != "" {
+		return d.PrivateIPv6, nil
+	}
 	return d.PrivateIP, nil
 }
 
 func (d *Driver) GetState() (state.State, error) {
-	p := govcd.NewVCDClient(*d.Url, d.Insecure)
-
 	log.Debug("Connecting to vCloud Director to fetch vApp Status...")
-	// Authenticate to vCloud Director
-	err := p.Authenticate(d.UserName, d.UserPassword, d.Org)
+	c, err := d.connect()
 	if err != nil {
 		return state.Error, err
 	}
 
-	org, err := p.GetOrgByName(d.Org)
+	vapp, err := c.vdc.GetVAppById(d.VAppID, true)
 	if err != nil {
 		return state.Error, err
 	}
 
-	vdc, err := org.GetVDCByName(d.VDC, true)
-	if err != nil {
-		return state.Error, err
-	}
+	return vappState(vapp), nil
+}
 
-	vapp, err := vdc.GetVAppById(d.VAppID, true)
-	if err != nil {
-		return state.Error, err
-	}
+func (d *Driver) Create() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	status, err := vapp.GetStatus()
+	rb := &rollback{}
+	err := d.create(ctx, rb)
 	if err != nil {
-		return state.Error, err
-	}
-
-	// if err = p.Disconnect(); err != nil {
-	// 	return state.Error, err
-	// }
-
-	switch status {
-	case "POWERED_ON":
-		return state.Running, nil
-	case "POWERED_OFF":
-		return state.Stopped, nil
+		if d.KeepOnFailure {
+			log.Warnf("Keeping the partially created %s for debugging, remove it with docker-machine rm", d.MachineName)
+			return err
+		}
+		if rb.run() {
+			d.Ledger = Ledger{}
+		}
 	}
-	return state.None, nil
+	return err
 }
 
-func (d *Driver) Create() error {
+// create provisions the machine, registering in rb how to undo every
+// resource it makes.
+func (d *Driver) create(ctx context.Context, rb *rollback) error {
 	key, err := d.createSSHKey()
 	if err != nil {
 		return err
 	}
 
-	p := govcd.NewVCDClient(*d.Url, d.Insecure)
-
-	log.Infof("Connecting to vCloud Director...")
-	// Authenticate to vCloud Director
-	err = p.Authenticate(d.UserName, d.UserPassword, d.Org)
+	c, err := d.connect()
 	if err != nil {
 		return err
 	}
+	p, org, vdc := c.client, c.org, c.vdc
 
-	org, err := p.GetOrgByName(d.Org)
+	nics, err := d.nicSpecs()
 	if err != nil {
 		return err
 	}
 
-	vdc, err := org.GetVDCByName(d.VDC, true)
-	if err != nil {
-		return err
+	log.Infof("Finding VDC Network...")
+	// Find VDC Networks, each one is attached to the vApp once
+	var networks []*types.OrgVDCNetwork
+	found := map[string]*types.OrgVDCNetwork{}
+	for _, nic := range nics {
+		network, ok := found[nic.Network]
+		if !ok {
+			orgNet, err := vdc.FindVDCNetwork(nic.Network)
+			if err != nil {
+				return err
+			}
+			network = orgNet.OrgVDCNetwork
+			found[nic.Network] = network
+			networks = append(networks, network)
+		}
+
+		if nic.IP != "" {
+			if err = checkStaticIP(network, nic.IP); err != nil {
+				return err
+			}
+		}
+	}
+	if d.PreferIPv6 && !hasIPv6Scope(found[nics[d.PrimaryNIC].Network]) {
+		return fmt.Errorf("-vcd-prefer-ipv6 needs an IPv6 subnet on Org VDC network %s", nics[d.PrimaryNIC].Network)
 	}
 
-	log.Infof("Finding VDC Network...")
-	// Find VDC Network
-	net, err := vdc.FindVDCNetwork(d.OrgVDCNet)
-	if err != nil {
-		return err
+	if d.PublicIP != "" {
+		if err = d.resolveEdgeGateway(c, nics[d.PrimaryNIC].Network); err != nil {
+			return err
+		}
+		if err = d.checkNatConflicts(c); err != nil {
+			return err
+		}
 	}
 
 	log.Infof("Finding Catalog...")
@@ -440,13 +894,11 @@ func (d *Driver) Create() error {
 	// Create a new empty vApp
 	vapp := govcd.NewVApp(&p.Client)
 
-	var networks []*types.OrgVDCNetwork
 	// Get StorageProfileReference
 	storageProfileRef, err := vdc.FindStorageProfileReference(d.StorProfile)
 	if err != nil {
 		return fmt.Errorf("Error finding storage profile: %s", err)
 	}
-	networks = append(networks, net.OrgVDCNetwork)
 
 	log.Infof("Creating a new vApp: %s...", d.MachineName)
 	// Compose the vApp with ComposeVApp
@@ -454,9 +906,24 @@ func (d *Driver) Create() error {
 	if err != nil {
 		return err
 	}
+	rb.add("vApp "+d.MachineName, func() error {
+		vapp, err := vdc.GetVAppByName(d.MachineName, true)
+		if govcd.ContainsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = d.deleteVApp(vapp); err != nil {
+			return err
+		}
+		d.VAppID = ""
+		return nil
+	})
 
 	// Wait for the creation to be completed
-	if err = task.WaitTaskCompletion(); err != nil {
+	createTimeout := time.Duration(d.CreateTimeout) * time.Second
+	if err = waitTask(ctx, "the vApp to be composed", createTimeout, task); err != nil {
 		return err
 	}
 
@@ -464,46 +931,51 @@ func (d *Driver) Create() error {
 	if err != nil {
 		return err
 	}
+	// Record the vApp straight away, so a machine kept after a failure can
+	// still be cleaned up with Remove.
+	d.VAppID = vapp.VApp.ID
+
 	vm, err := vapp.GetVMByName(d.MachineName, true)
 	if err != nil {
 		return err
 	}
+	d.Ledger.VMID = vm.VM.ID
 	// Wait vm is created
-	for {
+	err = waitFor(ctx, "the VM spec section", createTimeout, func() (bool, error) {
 		vapp, err = vdc.GetVAppByName(d.MachineName, true)
 		if err != nil {
-			return err
+			return false, err
 		}
 		vm, err = vapp.GetVMByName(d.MachineName, true)
 		if err != nil {
-			return err
-		}
-		time.Sleep(2 * time.Second)
-		if vm.VM.VmSpecSection != nil {
-			break
+			return false, err
 		}
+		return vm.VM.VmSpecSection != nil, nil
+	})
+	if err != nil {
+		return err
 	}
 	// Wait vm is status is not UNRESOLVED
-	for {
+	err = waitFor(ctx, "the vApp to leave UNRESOLVED", createTimeout, func() (bool, error) {
 		status, err := vapp.GetStatus()
 		if err != nil {
-			return fmt.Errorf("Get status vm: %s", err)
+			return false, fmt.Errorf("Get status vm: %s", err)
 		}
-		if status != "UNRESOLVED" {
-			break
-		}
-		time.Sleep(1 * time.Second)
+		return status != "UNRESOLVED", nil
+	})
+	if err != nil {
+		return err
 	}
 	// Wait vm is status is POWERED_OFF
-	for {
+	err = waitFor(ctx, "the vApp to be POWERED_OFF", createTimeout, func() (bool, error) {
 		status, err := vapp.GetStatus()
 		if err != nil {
-			return fmt.Errorf("Get status vm: %s", err)
+			return false, fmt.Errorf("Get status vm: %s", err)
 		}
-		if status == "POWERED_OFF" {
-			break
-		}
-		time.Sleep(1 * time.Second)
+		return status == "POWERED_OFF", nil
+	})
+	if err != nil {
+		return err
 	}
 
 	// Set VAppID with ID of the created VApp
@@ -524,34 +996,25 @@ func (d *Driver) Create() error {
 		return fmt.Errorf("Error changing size: %s", err)
 	}
 
-	// If the Network Adapter Type change.
-	if d.AdapterType != "" {
-		log.Infof("Change Network to %s...", d.AdapterType)
-		netCfg, err := vm.GetNetworkConnectionSection()
-		if err != nil {
-			return fmt.Errorf("Error read network section for update: %s", err)
-		}
-
-		netCfg.NetworkConnection = netCfg.NetworkConnection[:0]
-		err = vm.UpdateNetworkConnectionSection(netCfg)
-		if err != nil {
-			return fmt.Errorf("Error truncate network: %s", err)
+	// If several networks are given, the Network Adapter Type or the IP
+	// address allocation mode change.
+	changeNICs := len(d.Networks) > 0 || d.AdapterType != ""
+	if changeNICs && d.NICUpdate == nicUpdateReplace {
+		log.Infof("Replacing network adapters with %d new one(s)...", len(nics))
+		if err = d.replaceNICs(vm, nics); err != nil {
+			return err
 		}
-
-		secondNic := &types.NetworkConnection{
-			Network:                 d.OrgVDCNet,
-			NetworkAdapterType:      d.AdapterType,
-			IPAddressAllocationMode: d.IPAddressAllocationMode,
-			NetworkConnectionIndex:  0,
-			IsConnected:             true,
-			NeedsCustomization:      false,
+	} else if changeNICs || d.IPAddressAllocationMode != defaultIPAddressAllocationMode {
+		log.Infof("Updating %d network adapter(s) in place...", len(nics))
+		if err = d.updateNICsInPlace(vm, nics); err != nil {
+			return err
 		}
+	}
 
-		netCfg.NetworkConnection = append(netCfg.NetworkConnection, secondNic)
-
-		err = vm.UpdateNetworkConnectionSection(netCfg)
-		if err != nil {
-			return fmt.Errorf("Error update network: %s", err)
+	if d.IPv6 {
+		log.Infof("Allocating IPv6 addresses...")
+		if err = allocateIPv6(&p.Client, vm, found); err != nil {
+			return fmt.Errorf("Error allocating IPv6 address: %s", err)
 		}
 	}
 
@@ -582,6 +1045,8 @@ func (d *Driver) Create() error {
 	GuestCustomizationSection.CustomizationScript += "\nsed -i 's/.*PasswordAuthentication.*/PasswordAuthentication no/g' /etc/ssh/sshd_config\n"
 	GuestCustomizationSection.CustomizationScript += "\nservice sshd restart\n"
 
+	GuestCustomizationSection.CustomizationScript += d.networkCustomization()
+
 	// fix resolv
 	// GuestCustomizationSection.CustomizationScript += "\nsed -i_bak \"s/\\(nameserver\\) .*/\\1 127.0.0.53\\nnameserver 1.1.1.1/\" /etc/resolv.conf\n\n"
 
@@ -609,223 +1074,110 @@ func (d *Driver) Create() error {
 		return err
 	}
 
-	task, err = vapp.PowerOn()
-	if err != nil {
-		return err
-	}
-
 	log.Infof("Waiting for the VM to power on and run the customization script...")
-
-	if err = task.WaitTaskCompletion(); err != nil {
+	if err = d.runTaskWithin(ctx, "power on of "+d.MachineName, createTimeout, vapp.PowerOn); err != nil {
 		return err
 	}
 
-	for {
+	err = waitFor(ctx, "the VM to get an IP address", time.Duration(d.IPTimeout)*time.Second, func() (bool, error) {
 		vm, err = vapp.GetVMByName(d.MachineName, true)
 		if err != nil {
-			return err
+			return false, err
 		}
-		time.Sleep(2 * time.Second)
-		if vm.VM.NetworkConnectionSection.NetworkConnection[0].IPAddress != "" {
-			d.PrivateIP = vm.VM.NetworkConnectionSection.NetworkConnection[0].IPAddress
-			break
+		d.PrivateIP = nicAddress(vm.VM.NetworkConnectionSection, d.PrimaryNIC)
+		if !d.IPv6 {
+			return d.PrivateIP != "", nil
 		}
-	}
-
-	if d.EdgeGateway != "" && d.PublicIP != "" {
-		if d.VdcEdgeGateway != "" {
-			vdcGateway, err := org.GetVDCByName(d.VdcEdgeGateway, true)
-			if err != nil {
-				return err
-			}
-			edge, err := vdcGateway.GetEdgeGatewayByName(d.EdgeGateway, true)
-			if err != nil {
-				return err
-			}
-
-			log.Infof("Creating NAT and Firewall Rules on %s...", d.EdgeGateway)
-			task, err = edge.Create1to1Mapping(vm.VM.NetworkConnectionSection.NetworkConnection[0].IPAddress, d.PublicIP, d.MachineName)
-			if err != nil {
-				return err
-			}
-
-			if err = task.WaitTaskCompletion(); err != nil {
-				return err
-			}
-		} else {
-			snatRuleDefinition := &types.NsxtNatRule{
-				Name:              d.MachineName + "_snat",
-				Description:       d.MachineName,
-				Enabled:           true,
-				RuleType:          types.NsxtNatRuleTypeSnat,
-				ExternalAddresses: vm.VM.NetworkConnectionSection.NetworkConnection[0].IPAddress,
-				InternalAddresses: d.PublicIP,
-				FirewallMatch:     types.NsxtNatRuleFirewallMatchBypass,
-			}
-
-			dnatRuleDefinition := &types.NsxtNatRule{
-				Name:              d.MachineName + "_dnat",
-				Description:       d.MachineName,
-				Enabled:           true,
-				RuleType:          types.NsxtNatRuleTypeDnat,
-				ExternalAddresses: d.PublicIP,
-				InternalAddresses: vm.VM.NetworkConnectionSection.NetworkConnection[0].IPAddress,
-				FirewallMatch:     types.NsxtNatRuleFirewallMatchBypass,
-			}
-
-			adminOrg, err := p.GetAdminOrgByName(d.Org)
-			edge, err := adminOrg.GetNsxtEdgeGatewayByName(d.EdgeGateway)
-
-			_, err = edge.CreateNatRule(snatRuleDefinition)
-			if err != nil {
-				return err
-			}
 
-			_, err = edge.CreateNatRule(dnatRuleDefinition)
-			if err != nil {
-				return err
-			}
+		section, err := dualStackSection(&p.Client, vm)
+		if err != nil {
+			return false, err
+		}
+		d.PrivateIPv6 = nicIPv6Address(section, d.PrimaryNIC)
+		if !d.PreferIPv6 {
+			return d.PrivateIP != "", nil
 		}
+		return d.PrivateIPv6 != "", nil
+	})
+	if err != nil {
+		return err
 	}
 
-	// log.Debugf("Disconnecting from vCloud Director...")
-
-	// if err = p.Disconnect(); err != nil {
-	// 	return err
-	// }
-
-	// Set VAppID with ID of the created VApp
-	d.VAppID = vapp.VApp.ID
+	if d.PublicIP != "" {
+		if err = d.publish(c, found[nics[d.PrimaryNIC].Network], rb); err != nil {
+			return err
+		}
+	}
 
 	d.IPAddress, err = d.GetIP()
 	return err
 }
 
 func (d *Driver) Remove() error {
-	p := govcd.NewVCDClient(*d.Url, d.Insecure)
-
-	log.Infof("Connecting to vCloud Director...")
-	// Authenticate to vCloud Director
-	err := p.Authenticate(d.UserName, d.UserPassword, d.Org)
+	c, err := d.connect()
 	if err != nil {
 		return err
 	}
-
-	org, err := p.GetOrgByName(d.Org)
+	vapp, err := c.vdc.FindVAppByID(d.VAppID)
 	if err != nil {
-		return err
+		log.Infof("Can't find the vApp, assuming it was deleted already...")
+		return nil
 	}
 
-	vdc, err := org.GetVDCByName(d.VDC, true)
-	if err != nil {
-		return err
+	if d.SnapshotBeforeRemove {
+		// Taken before anything is torn down, so that a removal failing half
+		// way can be reverted. It goes away with the vApp otherwise.
+		if err = d.CreateSnapshot("before-remove", false, false); err != nil {
+			return fmt.Errorf("Unable to snapshot %s before removing it: %s", d.MachineName, err)
+		}
 	}
 
-	vapp, err := vdc.FindVAppByID(d.VAppID)
-	if err != nil {
-		log.Infof("Can't find the vApp, assuming it was deleted already...")
-		return nil
+	// A machine whose Create failed before reserving its auto public IP
+	// has no NAT rule.
+	if d.EdgeGateway != "" && d.PublicIP != "" && d.PublicIP != publicIPAuto {
+		if err = d.unpublish(c, &vapp); err != nil {
+			return err
+		}
 	}
 
+	return d.deleteVApp(&vapp)
+}
+
+// deleteVApp powers off, undeploys and deletes vapp.
+func (d *Driver) deleteVApp(vapp *govcd.VApp) error {
 	status, err := vapp.GetStatus()
 	if err != nil {
 		return err
 	}
 
-	if d.EdgeGateway != "" && d.PublicIP != "" {
-		if d.VdcEdgeGateway != "" {
-			vdcGateway, err := org.GetVDCByName(d.VdcEdgeGateway, true)
-			if err != nil {
-				return err
-			}
-			edge, err := vdcGateway.GetEdgeGatewayByName(d.EdgeGateway, true)
-			if err != nil {
-				return err
-			}
-
-			log.Infof("Removing NAT and Firewall Rules on %s...", d.EdgeGateway)
-			task, err := edge.Remove1to1Mapping(vapp.VApp.Children.VM[0].NetworkConnectionSection.NetworkConnection[0].IPAddress, d.PublicIP)
-			if err != nil {
-				return err
-			}
-			if err = task.WaitTaskCompletion(); err != nil {
-				return err
-			}
-		} else {
-			adminOrg, err := p.GetAdminOrgByName(d.Org)
-			edge, err := adminOrg.GetNsxtEdgeGatewayByName(d.EdgeGateway)
-
-			dnat, err := edge.GetNatRuleByName(d.MachineName + "_dnat")
-			if err != nil {
-				return err
-			}
-			dnat.Delete()
-
-			snat, err := edge.GetNatRuleByName(d.MachineName + "_snat")
-			if err != nil {
-				return err
-			}
-			snat.Delete()
-		}
-	}
-
 	if status == "POWERED_ON" {
 		// If it's powered on, power it off before deleting
 		log.Infof("Powering Off %s...", d.MachineName)
-		task, err := vapp.PowerOff()
-		if err != nil {
-			return err
-		}
-		if err = task.WaitTaskCompletion(); err != nil {
+		if err := d.runTask("power off of "+d.MachineName, vapp.PowerOff); err != nil {
 			return err
 		}
 
 	}
 
-	log.Debugf("Undeploying %s...", d.MachineName)
-	task, err := vapp.Undeploy()
-	if err != nil {
-		return err
-	}
-	if err = task.WaitTaskCompletion(); err != nil {
-		return err
+	// A vApp that was never powered on, e.g. one rolled back during Create,
+	// cannot be undeployed.
+	if vapp.VApp.Deployed {
+		log.Debugf("Undeploying %s...", d.MachineName)
+		if err := d.runTask("undeploy of "+d.MachineName, vapp.Undeploy); err != nil {
+			return err
+		}
 	}
 
 	log.Infof("Deleting %s...", d.MachineName)
-	task, err = vapp.Delete()
-	if err != nil {
-		return err
-	}
-	if err = task.WaitTaskCompletion(); err != nil {
-		return err
-	}
-
-	// if err = p.Disconnect(); err != nil {
-	// 	return err
-	// }
-
-	return nil
+	return d.runTask("deletion of "+d.MachineName, vapp.Delete)
 }
 
 func (d *Driver) Start() error {
-	p := govcd.NewVCDClient(*d.Url, d.Insecure)
-
-	log.Infof("Connecting to vCloud Director...")
-	// Authenticate to vCloud Director
-	err := p.Authenticate(d.UserName, d.UserPassword, d.Org)
-	if err != nil {
-		return err
-	}
-
-	org, err := p.GetOrgByName(d.Org)
-	if err != nil {
-		return err
-	}
-
-	vdc, err := org.GetVDCByName(d.VDC, true)
+	c, err := d.connect()
 	if err != nil {
 		return err
 	}
+	vdc := c.vdc
 
 	log.Infof("Finding vApp %s", d.VAppID)
 	vapp, err := vdc.FindVAppByID(d.VAppID)
@@ -838,146 +1190,108 @@ func (d *Driver) Start() error {
 		return err
 	}
 
-	if status == "POWERED_OFF" {
-		log.Infof("Starting %s...", d.MachineName)
-		task, err := vapp.PowerOn()
-		if err != nil {
-			return err
+	// Powering on a suspended vApp resumes it.
+	if status == "POWERED_OFF" || status == "SUSPENDED" {
+		if status == "SUSPENDED" {
+			log.Infof("Resuming %s...", d.MachineName)
+		} else {
+			log.Infof("Starting %s...", d.MachineName)
 		}
-		if err = task.WaitTaskCompletion(); err != nil {
+		if err := d.runTask("power on of "+d.MachineName, vapp.PowerOn); err != nil {
 			return err
 		}
 
 	}
 
-	// if err = p.Disconnect(); err != nil {
-	// 	return err
-	// }
-
 	d.IPAddress, err = d.GetIP()
 	return err
 }
 
 func (d *Driver) Stop() error {
-	p := govcd.NewVCDClient(*d.Url, d.Insecure)
-
-	log.Infof("Connecting to vCloud Director...")
-	// Authenticate to vCloud Director
-	err := p.Authenticate(d.UserName, d.UserPassword, d.Org)
+	c, err := d.connect()
 	if err != nil {
 		return err
 	}
+	vdc := c.vdc
 
-	org, err := p.GetOrgByName(d.Org)
+	vapp, err := vdc.FindVAppByID(d.VAppID)
 	if err != nil {
 		return err
 	}
 
-	vdc, err := org.GetVDCByName(d.VDC, true)
+	status, err := vapp.GetStatus()
 	if err != nil {
 		return err
 	}
 
-	vapp, err := vdc.FindVAppByID(d.VAppID)
-	if err != nil {
-		return err
+	if status == "POWERED_ON" {
+		how, err := d.stopVApp(context.Background(), vdc, &vapp)
+		if err != nil {
+			return err
+		}
+		log.Infof("Stopped %s by %s", d.MachineName, how)
 	}
 
-	task, err := vapp.Shutdown()
-	if err != nil {
-		return err
-	}
-	if err = task.WaitTaskCompletion(); err != nil {
-		return err
+	if d.StopUndeploy {
+		log.Infof("Undeploying %s to release its resources...", d.MachineName)
+		if err := d.runTask("undeploy of "+d.MachineName, vapp.Undeploy); err != nil {
+			return err
+		}
 	}
 
-	// if err = p.Disconnect(); err != nil {
-	// 	return err
-	// }
-
 	d.IPAddress = ""
 
 	return nil
 }
 
 func (d *Driver) Restart() error {
-	p := govcd.NewVCDClient(*d.Url, d.Insecure)
-
-	log.Infof("Connecting to vCloud Director...")
-	// Authenticate to vCloud Director
-	err := p.Authenticate(d.UserName, d.UserPassword, d.Org)
-	if err != nil {
-		return err
-	}
-
-	org, err := p.GetOrgByName(d.Org)
-	if err != nil {
-		return err
-	}
-
-	vdc, err := org.GetVDCByName(d.VDC, true)
+	c, err := d.connect()
 	if err != nil {
 		return err
 	}
+	vdc := c.vdc
 
 	vapp, err := vdc.FindVAppByID(d.VAppID)
 	if err != nil {
 		return err
 	}
 
-	task, err := vapp.Reset()
-	if err != nil {
-		return err
+	if d.RestartMode == restartModeReboot {
+		if !guestToolsRunning(vdc, &vapp) {
+			log.Warnf("VMware Tools are not running in %s, resetting it instead of rebooting", d.MachineName)
+		} else if err = d.rebootVApp(context.Background(), &vapp); err != nil {
+			log.Warnf("Guest reboot of %s did not finish, resetting it: %s", d.MachineName, err)
+		} else {
+			d.IPAddress, err = d.GetIP()
+			return err
+		}
 	}
-	if err = task.WaitTaskCompletion(); err != nil {
+
+	log.Infof("Resetting %s...", d.MachineName)
+	if err := d.runTask("reset of "+d.MachineName, vapp.Reset); err != nil {
 		return err
 	}
 
-	// if err = p.Disconnect(); err != nil {
-	// 	return err
-	// }
-
 	d.IPAddress, err = d.GetIP()
 	return err
 }
 
 func (d *Driver) Kill() error {
-	p := govcd.NewVCDClient(*d.Url, d.Insecure)
-
-	log.Infof("Connecting to vCloud Director...")
-	// Authenticate to vCloud Director
-	err := p.Authenticate(d.UserName, d.UserPassword, d.Org)
-	if err != nil {
-		return err
-	}
-
-	org, err := p.GetOrgByName(d.Org)
-	if err != nil {
-		return err
-	}
-
-	vdc, err := org.GetVDCByName(d.VDC, true)
+	c, err := d.connect()
 	if err != nil {
 		return err
 	}
+	vdc := c.vdc
 
 	vapp, err := vdc.FindVAppByID(d.VAppID)
 	if err != nil {
 		return err
 	}
 
-	task, err := vapp.PowerOff()
-	if err != nil {
-		return err
-	}
-	if err = task.WaitTaskCompletion(); err != nil {
+	if err := d.runTask("power off of "+d.MachineName, vapp.PowerOff); err != nil {
 		return err
 	}
 
-	// if err = p.Disconnect(); err != nil {
-	// 	return err
-	// }
-
 	d.IPAddress = ""
 
 	return nil
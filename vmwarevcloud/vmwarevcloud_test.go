@@ -19,9 +19,17 @@
 package vmwarevcloud
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+
 	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/state"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,12 +38,13 @@ func TestSetConfigFromFlags(t *testing.T) {
 
 	checkFlags := &drivers.CheckDriverOptions{
 		FlagsValues: map[string]interface{}{
-			"vcd-username":    "root",
-			"vcd-password":    "pwd",
-			"vcd-vdc":         "VDC",
-			"vcd-storprofile": "name",
-			"vcd-org":         "org",
-			"vcd-href":        "https://example.com/api",
+			"vcd-username":      "root",
+			"vcd-password":      "pwd",
+			"vcd-store-secrets": true,
+			"vcd-vdc":           "VDC",
+			"vcd-storprofile":   "name",
+			"vcd-org":           "org",
+			"vcd-href":          "https://example.com/api",
 		},
 		CreateFlags: driver.GetCreateFlags(),
 	}
@@ -45,3 +54,184 @@ func TestSetConfigFromFlags(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Empty(t, checkFlags.InvalidFlags)
 }
+
+func TestSetConfigFromFlagsWithToken(t *testing.T) {
+	driver := NewDriver("default", "path")
+
+	checkFlags := &drivers.CheckDriverOptions{
+		FlagsValues: map[string]interface{}{
+			"vcd-api-token-source": "env:VCD_API_TOKEN",
+			"vcd-vdc":              "VDC",
+			"vcd-storprofile":      "name",
+			"vcd-org":              "org",
+			"vcd-href":             "https://example.com/api",
+		},
+		CreateFlags: driver.GetCreateFlags(),
+	}
+
+	err := driver.SetConfigFromFlags(checkFlags)
+
+	assert.NoError(t, err)
+	assert.Empty(t, checkFlags.InvalidFlags)
+}
+
+func TestSetConfigFromFlagsCredentials(t *testing.T) {
+	for name, values := range map[string]map[string]interface{}{
+		"none":           {},
+		"user only":      {"vcd-username": "root"},
+		"password+token": {"vcd-username": "root", "vcd-password": "pwd", "vcd-token": "token", "vcd-store-secrets": true},
+		"not stored":     {"vcd-username": "root", "vcd-password": "pwd"},
+		"source no user": {"vcd-password-source": "env:VCD_PASSWORD"},
+	} {
+		driver := NewDriver("default", "path")
+
+		values["vcd-vdc"] = "VDC"
+		values["vcd-storprofile"] = "name"
+		values["vcd-org"] = "org"
+		values["vcd-href"] = "https://example.com/api"
+
+		checkFlags := &drivers.CheckDriverOptions{
+			FlagsValues: values,
+			CreateFlags: driver.GetCreateFlags(),
+		}
+
+		assert.Error(t, driver.SetConfigFromFlags(checkFlags), name)
+	}
+}
+
+func TestSetConfigFromFlagsPortForward(t *testing.T) {
+	for _, allowed := range [][]string{nil, {"6443"}} {
+		driver := NewDriver("default", "path")
+
+		checkFlags := &drivers.CheckDriverOptions{
+			FlagsValues: map[string]interface{}{
+				"vcd-username":      "root",
+				"vcd-password":      "pwd",
+				"vcd-store-secrets": true,
+				"vcd-vdc":           "VDC",
+				"vcd-storprofile":   "name",
+				"vcd-org":           "org",
+				"vcd-href":          "https://example.com/api",
+				"vcd-publicip":      "203.0.113.10",
+				"vcd-nat-mode":      "port-forward",
+				"vcd-allowed-port":  allowed,
+			},
+			CreateFlags: driver.GetCreateFlags(),
+		}
+
+		err := driver.SetConfigFromFlags(checkFlags)
+		if allowed == nil {
+			assert.NoError(t, err)
+		} else {
+			// Only SSH and Docker are forwarded, there is no DNAT rule for
+			// the allowed ports to open.
+			assert.Error(t, err)
+		}
+	}
+}
+
+// fakeVApp serves the VDC and vApp of a machine from a fake vCloud
+// Director and records the power actions posted to the vApp.
+type fakeVApp struct {
+	status  int
+	actions []string
+}
+
+// Statuses of types.VAppStatuses.
+const (
+	vappSuspended  = 3
+	vappPoweredOn  = 4
+	vappPoweredOff = 8
+)
+
+// newFakeVAppDriver returns a driver connected to a fake vCloud Director
+// holding one vApp with status.
+func newFakeVAppDriver(t *testing.T, status int) (*Driver, *fakeVApp) {
+	vapp := &fakeVApp{status: status}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base := "http://" + r.Host + "/api"
+		switch {
+		case r.URL.Path == "/api/vdc/1":
+			fmt.Fprintf(w, `<Vdc xmlns="http://www.vmware.com/vcloud/v1.5" href="%s/vdc/1" name="vdc"><ResourceEntities>`+
+				`<ResourceEntity type="application/vnd.vmware.vcloud.vApp+xml" id="urn:vcloud:vapp:00000000-0000-0000-0000-000000000001" href="%s/vApp/vapp-00000000-0000-0000-0000-000000000001" name="default"/>`+
+				`</ResourceEntities></Vdc>`, base, base)
+		case r.URL.Path == "/api/vApp/vapp-00000000-0000-0000-0000-000000000001":
+			fmt.Fprintf(w, `<VApp xmlns="http://www.vmware.com/vcloud/v1.5" href="%s/vApp/vapp-00000000-0000-0000-0000-000000000001" name="default" status="%d"/>`, base, vapp.status)
+		case strings.HasPrefix(r.URL.Path, "/api/vApp/vapp-00000000-0000-0000-0000-000000000001/power/action/"):
+			action := strings.TrimPrefix(r.URL.Path, "/api/vApp/vapp-00000000-0000-0000-0000-000000000001/power/action/")
+			vapp.actions = append(vapp.actions, action)
+			switch action {
+			case "powerOn":
+				vapp.status = vappPoweredOn
+			case "suspend":
+				vapp.status = vappSuspended
+			}
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, `<Task xmlns="http://www.vmware.com/vcloud/v1.5" status="running" href="%s/task/1"/>`, base)
+		case r.URL.Path == "/api/task/1":
+			fmt.Fprintf(w, `<Task xmlns="http://www.vmware.com/vcloud/v1.5" status="success" href="%s/task/1"/>`, base)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	endpoint, err := url.Parse(server.URL + "/api")
+	assert.NoError(t, err)
+	client := govcd.NewVCDClient(*endpoint, true)
+	vdc := govcd.NewVdc(&client.Client)
+	vdc.Vdc.HREF = server.URL + "/api/vdc/1"
+
+	d := NewDriver("default", "path").(*Driver)
+	d.Href, d.Org, d.UserName, d.VDC = server.URL+"/api", "org", "root", "vdc"
+	d.VAppID = "urn:vcloud:vapp:00000000-0000-0000-0000-000000000001"
+	d.PrivateIP = "192.168.10.20"
+
+	key := d.sessionKey()
+	sessionsMu.Lock()
+	sessions[key] = &vcdSession{client: client, vdcs: map[string]*govcd.Vdc{"vdc": vdc}}
+	sessionsMu.Unlock()
+	t.Cleanup(func() {
+		sessionsMu.Lock()
+		delete(sessions, key)
+		sessionsMu.Unlock()
+	})
+
+	return d, vapp
+}
+
+func TestGetStateSuspended(t *testing.T) {
+	d, _ := newFakeVAppDriver(t, vappSuspended)
+
+	s, err := d.GetState()
+	assert.NoError(t, err)
+	assert.Equal(t, state.Saved, s)
+}
+
+func TestStartResumesSuspended(t *testing.T) {
+	d, vapp := newFakeVAppDriver(t, vappSuspended)
+
+	assert.NoError(t, d.Start())
+	assert.Equal(t, []string{"powerOn"}, vapp.actions)
+	assert.Equal(t, "192.168.10.20", d.IPAddress)
+
+	// A running machine is left alone.
+	vapp.actions = nil
+	assert.NoError(t, d.Start())
+	assert.Empty(t, vapp.actions)
+}
+
+func TestSuspend(t *testing.T) {
+	d, vapp := newFakeVAppDriver(t, vappPoweredOn)
+
+	assert.NoError(t, d.Suspend())
+	assert.Equal(t, []string{"suspend"}, vapp.actions)
+
+	// Suspending again is a no-op.
+	assert.NoError(t, d.Suspend())
+	assert.Equal(t, []string{"suspend"}, vapp.actions)
+
+	vapp.status = vappPoweredOff
+	assert.Error(t, d.Suspend())
+	assert.Equal(t, []string{"suspend"}, vapp.actions)
+}
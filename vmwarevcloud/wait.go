@@ -0,0 +1,99 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	pollInitialInterval = 1 * time.Second
+	pollMaxInterval     = 15 * time.Second
+)
+
+// waitFor polls check with exponential backoff until it reports done, the
+// timeout elapses or ctx is cancelled. The error names phase so that a
+// stuck provisioning step can be told apart from the others.
+func waitFor(ctx context.Context, phase string, timeout time.Duration, check func() (bool, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	interval := pollInitialInterval
+	for {
+		done, err := check()
+		if err != nil {
+			return fmt.Errorf("Error waiting for %s: %s", phase, err)
+		}
+		if done {
+			return nil
+		}
+
+		log.Debugf("Still waiting for %s, next check in %s", phase, interval)
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("Timed out after %s waiting for %s", timeout, phase)
+			}
+			return fmt.Errorf("Cancelled waiting for %s: %s", phase, ctx.Err())
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > pollMaxInterval {
+			interval = pollMaxInterval
+		}
+	}
+}
+
+// waitTask waits for a vCloud Director task like waitFor. A task still
+// running when the timeout elapses is cancelled, so that it does not block
+// whatever the caller does next.
+func waitTask(ctx context.Context, phase string, timeout time.Duration, task govcd.Task) error {
+	err := waitFor(ctx, phase, timeout, func() (bool, error) {
+		if err := task.Refresh(); err != nil {
+			return false, err
+		}
+
+		switch task.Task.Status {
+		case "success":
+			return true, nil
+		case "error", "aborted", "canceled":
+			if task.Task.Error != nil {
+				return false, fmt.Errorf("task %s: %s", task.Task.Status, task.Task.Error.Message)
+			}
+			return false, fmt.Errorf("task %s", task.Task.Status)
+		}
+		return false, nil
+	})
+
+	if err != nil && task.Task.Status != "success" && task.Task.Status != "error" &&
+		task.Task.Status != "aborted" && task.Task.Status != "canceled" {
+		if cerr := task.CancelTask(); cerr != nil {
+			log.Debugf("Unable to cancel task for %s: %s", phase, cerr)
+		}
+	}
+
+	return err
+}
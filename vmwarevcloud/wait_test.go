@@ -0,0 +1,74 @@
+/*
+* docker-machine-driver-vcd
+* Copyright (C) 2022  Aleksandr Negashev (i@negash.ru)
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vmwarevcloud
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	govcd "github.com/vmware/go-vcloud-director/v2/govcd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitFor(t *testing.T) {
+	calls := 0
+	err := waitFor(context.Background(), "done", time.Second, func() (bool, error) {
+		calls++
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	err = waitFor(context.Background(), "an IP address", 10*time.Millisecond, func() (bool, error) {
+		return false, nil
+	})
+	assert.EqualError(t, err, "Timed out after 10ms waiting for an IP address")
+}
+
+func TestWaitTaskTimeout(t *testing.T) {
+	cancelled := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/action/cancel") {
+			cancelled = true
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// A task that never finishes.
+		w.Header().Set("Content-Type", "application/vnd.vmware.vcloud.task+xml")
+		fmt.Fprintf(w, `<Task xmlns="http://www.vmware.com/vcloud/v1.5" status="running" href="%s%s"/>`, "http://"+r.Host, r.URL.Path)
+	}))
+	defer server.Close()
+
+	endpoint, err := url.Parse(server.URL + "/api")
+	assert.NoError(t, err)
+	client := govcd.NewVCDClient(*endpoint, true)
+	task := govcd.NewTask(&client.Client)
+	task.Task.HREF = server.URL + "/api/task/1"
+
+	err = waitTask(context.Background(), "the vApp to be composed", 50*time.Millisecond, *task)
+	assert.EqualError(t, err, "Timed out after 50ms waiting for the vApp to be composed")
+	assert.True(t, cancelled)
+}